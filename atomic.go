@@ -0,0 +1,41 @@
+//go:build go1.19
+// +build go1.19
+
+package intern
+
+import "sync/atomic"
+
+// AtomicRepository holds a repository that can be swapped atomically. It
+// supports the read-mostly pattern where a writer periodically builds a new
+// repository and publishes it with Store, while readers call Load to get a
+// stable repository for a batch of lookups:
+//
+//	repo := atomicRepo.Load()
+//	for _, str := range batch {
+//		id, ok := repo.Lookup(str)
+//		...
+//	}
+//
+// A repository must not be modified once it has been stored, since readers
+// may be using it concurrently. Lookups on an unmodified repository are
+// safe from multiple goroutines
+type AtomicRepository struct {
+	ptr atomic.Pointer[Repository]
+}
+
+// NewAtomicRepository creates a new AtomicRepository holding repo
+func NewAtomicRepository(repo *Repository) *AtomicRepository {
+	atomicRepo := &AtomicRepository{}
+	atomicRepo.Store(repo)
+	return atomicRepo
+}
+
+// Load returns the current repository
+func (atomicRepo *AtomicRepository) Load() *Repository {
+	return atomicRepo.ptr.Load()
+}
+
+// Store replaces the current repository
+func (atomicRepo *AtomicRepository) Store(repo *Repository) {
+	atomicRepo.ptr.Store(repo)
+}
@@ -0,0 +1,54 @@
+//go:build go1.19
+// +build go1.19
+
+package intern
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestAtomicRepository(t *testing.T) {
+	build := func(version int) *Repository {
+		repo := NewRepository()
+		repo.Intern(fmt.Sprintf("version%d", version))
+		for i := 0; i < 100; i++ {
+			repo.Intern(fmt.Sprintf("x%d", i))
+		}
+		return repo
+	}
+
+	atomicRepo := NewAtomicRepository(build(0))
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				repo := atomicRepo.Load()
+				str, ok := repo.LookupID(1)
+				if !ok {
+					t.Error("invalid LookupID() result")
+					return
+				}
+				if id, ok := repo.Lookup(str); !ok || id != 1 {
+					t.Error("invalid Lookup() result")
+					return
+				}
+				if id, ok := repo.Lookup("x50"); !ok || id != 52 {
+					t.Error("invalid Lookup() result")
+					return
+				}
+			}
+		}()
+	}
+	for version := 1; version <= 50; version++ {
+		atomicRepo.Store(build(version))
+	}
+	wg.Wait()
+
+	if str, _ := atomicRepo.Load().LookupID(1); str != "version50" {
+		t.Error("invalid Load() result")
+	}
+}
@@ -2,6 +2,10 @@ package intern
 
 import (
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -60,6 +64,60 @@ func BenchmarkLookupIDThatDoesntExist(b *testing.B) {
 	benchmarkLookupID(b, "foobar", false)
 }
 
+func benchmarkLookupHotIDs(b *testing.B, opts Options) {
+	repo := NewRepositoryWithOptions(opts)
+	for i := 0; i < 1000; i++ {
+		repo.Intern(fmt.Sprintf("string %d", i))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		repo.LookupID(uint32(i%16) + 1)
+	}
+}
+
+func BenchmarkLookupHotIDs(b *testing.B) {
+	benchmarkLookupHotIDs(b, Options{})
+}
+
+func BenchmarkLookupHotIDsCached(b *testing.B) {
+	benchmarkLookupHotIDs(b, Options{LookupCacheSize: 64})
+}
+
+func benchmarkDecodeRow(b *testing.B, decode func(repo *Repository, ids []uint32, row []byte) []byte) {
+	repo := NewRepository()
+	ids := make([]uint32, 16)
+	for i := range ids {
+		ids[i] = repo.Intern(fmt.Sprintf("column value %d", i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var row []byte
+	for i := 0; i < b.N; i++ {
+		row = decode(repo, ids, row[:0])
+	}
+}
+
+func BenchmarkDecodeRowLookupIDBytesInto(b *testing.B) {
+	benchmarkDecodeRow(b, func(repo *Repository, ids []uint32, row []byte) []byte {
+		for _, id := range ids {
+			row, _ = repo.LookupIDBytesInto(id, row)
+		}
+		return row
+	})
+}
+
+func BenchmarkDecodeRowLookupID(b *testing.B) {
+	benchmarkDecodeRow(b, func(repo *Repository, ids []uint32, row []byte) []byte {
+		for _, id := range ids {
+			str, _ := repo.LookupID(id)
+			row = append(row, str...)
+		}
+		return row
+	})
+}
+
 func BenchmarkOptimize1k(b *testing.B) {
 	repo := NewRepository()
 	for i := 1; i <= 1000; i++ {
@@ -75,3 +133,430 @@ func BenchmarkOptimize1k(b *testing.B) {
 		repo.Optimize(freq)
 	}
 }
+
+// benchmarkOptimizeMemory reports the bytes allocated by libintern that
+// remain live after optimizing a repository
+func benchmarkOptimizeMemory(b *testing.B, inPlace bool) {
+	var live uint64
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		repo := NewRepository()
+		freq := NewFrequency()
+		for j := 0; j < 100000; j++ {
+			freq.Add(repo.Intern(fmt.Sprintf("string %d", j%(j%7+1)*j)))
+		}
+		b.StartTimer()
+		if inPlace {
+			repo.OptimizeInPlace(freq)
+			live = repo.AllocatedBytes()
+		} else {
+			optimized := repo.Optimize(freq)
+			live = repo.AllocatedBytes() + optimized.AllocatedBytes()
+		}
+	}
+	b.ReportMetric(float64(live), "live-bytes")
+}
+
+func BenchmarkOptimizeMemory100k(b *testing.B) {
+	benchmarkOptimizeMemory(b, false)
+}
+
+func BenchmarkOptimizeInPlaceMemory100k(b *testing.B) {
+	benchmarkOptimizeMemory(b, true)
+}
+
+func BenchmarkIngest1M(b *testing.B) {
+	strs := make([]string, 1000000)
+	for i := range strs {
+		strs[i] = fmt.Sprintf("%d", i)
+	}
+
+	b.ResetTimer()
+	var steps int
+	for i := 0; i < b.N; i++ {
+		repo := NewRepository()
+		size := repo.AllocatedBytes()
+		for _, str := range strs {
+			repo.Intern(str)
+			if allocated := repo.AllocatedBytes(); allocated != size {
+				size = allocated
+				steps++
+			}
+		}
+	}
+	b.ReportMetric(float64(steps)/float64(b.N), "growths/op")
+}
+
+func BenchmarkIDCursor1k(b *testing.B) {
+	repo := NewRepository()
+	for i := 1; i <= 1000; i++ {
+		repo.Intern(fmt.Sprintf("%d", i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cursor := repo.IDCursor()
+		for cursor.Next() {
+			cursor.ID()
+		}
+	}
+}
+
+func benchmarkLookupIDs(b *testing.B, reuse bool) {
+	repo := NewRepository()
+	ids := make([]uint32, 1000)
+	for i := range ids {
+		ids[i] = repo.Intern(fmt.Sprintf("%d", i%10))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var dst []string
+	for i := 0; i < b.N; i++ {
+		if !reuse {
+			dst = nil
+		}
+		dst, _ = repo.LookupIDsInto(ids, dst)
+	}
+}
+
+func BenchmarkLookupIDsInto(b *testing.B) {
+	benchmarkLookupIDs(b, true)
+}
+
+func BenchmarkLookupIDsIntoWithoutReuse(b *testing.B) {
+	benchmarkLookupIDs(b, false)
+}
+
+func benchmarkHas(b *testing.B, batch bool) {
+	repo := NewRepository()
+	strs := make([]string, 1000)
+	for i := range strs {
+		strs[i] = fmt.Sprintf("%d", i)
+		if i%2 == 0 {
+			repo.Intern(strs[i])
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if batch {
+			repo.HasAll(strs)
+		} else {
+			for _, str := range strs {
+				repo.Contains(str)
+			}
+		}
+	}
+}
+
+func BenchmarkHasAll(b *testing.B) {
+	benchmarkHas(b, true)
+}
+
+func BenchmarkContainsLoop(b *testing.B) {
+	benchmarkHas(b, false)
+}
+
+func BenchmarkWriteTo100k(b *testing.B) {
+	repo := NewRepository()
+	for i := 0; i < 100000; i++ {
+		repo.Intern(fmt.Sprintf("string %d", i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		repo.WriteTo(ioutil.Discard)
+	}
+}
+
+func BenchmarkForEachBytes100k(b *testing.B) {
+	repo := NewRepository()
+	for i := 0; i < 100000; i++ {
+		repo.Intern(fmt.Sprintf("string %d", i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var total int
+		repo.ForEachBytes(func(id uint32, b []byte) bool {
+			total += len(b)
+			return true
+		})
+	}
+}
+
+func benchmarkCorpus(count int) []string {
+	strs := make([]string, count)
+	for i := range strs {
+		strs[i] = fmt.Sprintf("token %d", i%(count/4))
+	}
+	return strs
+}
+
+func BenchmarkInternAll100k(b *testing.B) {
+	strs := benchmarkCorpus(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewRepository().InternAll(strs)
+	}
+}
+
+func benchmarkCursorSkip(b *testing.B, skip func(*Cursor, int)) {
+	repo := NewRepository()
+	for i := 0; i < 10000; i++ {
+		repo.Intern(fmt.Sprintf("string %d", i))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		skip(repo.Cursor(), 9999)
+	}
+}
+
+func benchmarkCursorScan(b *testing.B, scan func(*Cursor) int) {
+	repo := NewRepository()
+	for i := 0; i < 10000; i++ {
+		repo.Intern(fmt.Sprintf("string %d", i))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		scan(repo.Cursor())
+	}
+}
+
+func BenchmarkCursorAt10k(b *testing.B) {
+	benchmarkCursorScan(b, func(cursor *Cursor) int {
+		var total int
+		for cursor.Next() {
+			id, str := cursor.At()
+			total += int(id) + len(str)
+		}
+		return total
+	})
+}
+
+func BenchmarkCursorIDAndString10k(b *testing.B) {
+	benchmarkCursorScan(b, func(cursor *Cursor) int {
+		var total int
+		for cursor.Next() {
+			total += int(cursor.ID()) + len(cursor.String())
+		}
+		return total
+	})
+}
+
+func BenchmarkCursorSkipN10k(b *testing.B) {
+	benchmarkCursorSkip(b, func(cursor *Cursor, n int) {
+		cursor.SkipN(n)
+	})
+}
+
+func BenchmarkCursorNext10k(b *testing.B) {
+	benchmarkCursorSkip(b, func(cursor *Cursor, n int) {
+		for ; n > 0; n-- {
+			cursor.Next()
+		}
+	})
+}
+
+func benchmarkRunesCorpus(count int) [][]rune {
+	strs := benchmarkCorpus(count)
+	rs := make([][]rune, len(strs))
+	for i, str := range strs {
+		rs[i] = []rune(str)
+	}
+	return rs
+}
+
+func BenchmarkInternRunes100k(b *testing.B) {
+	rs := benchmarkRunesCorpus(100000)
+	repo := NewRepository()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		repo.InternRunes(rs[i%len(rs)])
+	}
+}
+
+func BenchmarkInternRunesString100k(b *testing.B) {
+	rs := benchmarkRunesCorpus(100000)
+	repo := NewRepository()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		repo.Intern(string(rs[i%len(rs)]))
+	}
+}
+
+func benchmarkBytesCorpus(count int) [][]byte {
+	strs := benchmarkCorpus(count)
+	bs := make([][]byte, len(strs))
+	for i, str := range strs {
+		bs[i] = []byte(str)
+	}
+	return bs
+}
+
+func BenchmarkInternBytesAll100k(b *testing.B) {
+	bs := benchmarkBytesCorpus(100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewRepository().InternBytesAll(bs)
+	}
+}
+
+func BenchmarkInternAllConvertingBytes100k(b *testing.B) {
+	bs := benchmarkBytesCorpus(100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		strs := make([]string, len(bs))
+		for j := range bs {
+			strs[j] = string(bs[j])
+		}
+		NewRepository().InternAll(strs)
+	}
+}
+
+func benchmarkSkewedBatch(b *testing.B, opts Options) {
+	strs := make([]string, 100000)
+	for i := range strs {
+		if i%10 == 0 {
+			strs[i] = fmt.Sprintf("cold %d", i)
+		} else {
+			strs[i] = fmt.Sprintf("hot %d", i%16)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewRepositoryWithOptions(opts).InternAll(strs)
+	}
+}
+
+func BenchmarkInternAllSkewed100k(b *testing.B) {
+	benchmarkSkewedBatch(b, Options{})
+}
+
+func BenchmarkInternAllSkewedBatchCache100k(b *testing.B) {
+	benchmarkSkewedBatch(b, Options{BatchCacheSize: 1024})
+}
+
+func benchmarkSortedInput(b *testing.B, sorted bool) {
+	strs := shuffledBenchmarkCorpus(100000)
+	b.ResetTimer()
+	var repo *Repository
+	for i := 0; i < b.N; i++ {
+		repo = NewRepository()
+		if sorted {
+			repo.InternAllSortedInput(strs)
+		} else {
+			repo.InternAll(strs)
+		}
+	}
+	b.ReportMetric(float64(repo.AllocatedBytes()), "allocated-bytes")
+}
+
+func BenchmarkInternAllUnsortedInput100k(b *testing.B) {
+	benchmarkSortedInput(b, false)
+}
+
+func BenchmarkInternAllSortedInput100k(b *testing.B) {
+	benchmarkSortedInput(b, true)
+}
+
+// benchmarkSortedInputLookup looks up runs of strings with a shared prefix,
+// which are adjacent in a repository built from sorted input
+func benchmarkSortedInputLookup(b *testing.B, sorted bool) {
+	strs := shuffledBenchmarkCorpus(100000)
+	repo := NewRepository()
+	var ids []uint32
+	if sorted {
+		ids = repo.InternAllSortedInput(strs)
+	} else {
+		ids = repo.InternAll(strs)
+	}
+	lookups := make([]uint32, 0, 1000)
+	for i, str := range strs {
+		if strings.HasPrefix(str, "token 1") && len(lookups) < cap(lookups) {
+			lookups = append(lookups, ids[i])
+		}
+	}
+	b.ResetTimer()
+	var row []byte
+	for i := 0; i < b.N; i++ {
+		row = row[:0]
+		for _, id := range lookups {
+			row, _ = repo.LookupIDBytesInto(id, row)
+		}
+	}
+}
+
+func BenchmarkLookupUnsortedInput(b *testing.B) {
+	benchmarkSortedInputLookup(b, false)
+}
+
+func BenchmarkLookupSortedInput(b *testing.B) {
+	benchmarkSortedInputLookup(b, true)
+}
+
+func shuffledBenchmarkCorpus(count int) []string {
+	strs := benchmarkCorpus(count)
+	r := rand.New(rand.NewSource(1))
+	r.Shuffle(len(strs), func(i, j int) { strs[i], strs[j] = strs[j], strs[i] })
+	return strs
+}
+
+func BenchmarkInternAllShuffled100k(b *testing.B) {
+	strs := shuffledBenchmarkCorpus(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewRepository().InternAll(strs)
+	}
+}
+
+func BenchmarkInternAllUnorderedShuffled100k(b *testing.B) {
+	strs := shuffledBenchmarkCorpus(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewRepository().InternAllUnordered(strs)
+	}
+}
+
+func BenchmarkInternBatchParallel100k(b *testing.B) {
+	strs := benchmarkCorpus(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		InternBatchParallel(strs, runtime.GOMAXPROCS(0))
+	}
+}
+
+func benchmarkFrequency(b *testing.B, presize bool) {
+	const count = 1000000
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var freq *Frequency
+		if presize {
+			freq = NewFrequencyWithCapacity(count)
+		} else {
+			freq = NewFrequency()
+		}
+		for id := uint32(1); id <= count; id++ {
+			freq.Add(id)
+		}
+	}
+}
+
+func BenchmarkFrequency1M(b *testing.B) {
+	benchmarkFrequency(b, false)
+}
+
+func BenchmarkFrequencyWithCapacity1M(b *testing.B) {
+	benchmarkFrequency(b, true)
+}
@@ -0,0 +1,683 @@
+package intern
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+)
+
+// ErrUnsupportedVersion is returned when decoding a repository that was
+// encoded with a newer, unknown format
+var ErrUnsupportedVersion = newError("unsupported version")
+
+// ErrInvalidFormat is returned by NewRepositoryFrom when the input is not a
+// valid serialized repository
+var ErrInvalidFormat = newError("invalid format")
+
+// ErrNotEmpty is returned when decoding into a repository that already
+// contains strings
+var ErrNotEmpty = newError("repository is not empty")
+
+// ErrInvalidPatch is returned by ApplyPatch when the patch is malformed or
+// its strings conflict with the repository
+var ErrInvalidPatch = newError("invalid patch")
+
+// ErrPatchOutOfOrder is returned by ApplyPatch when the patch was not taken
+// from a snapshot with the same number of strings as the repository
+var ErrPatchOutOfOrder = newError("patch out of order")
+
+// formatVersion is the current version of the format written by WriteTo.
+// Version 1 lacked the checksum, and version 2 lacked the ID mapping
+const formatVersion = 3
+
+// formatCodecs decodes and verifies each version of the format written by
+// WriteTo, indexed by version, from just after the version byte. To add a
+// version, increment formatVersion, add a codec here and update WriteTo
+var formatCodecs = [formatVersion + 1]formatCodec{
+	1: {decodeFormatV1, verifyFormatV1},
+	2: {decodeFormatV2, verifyFormatV2},
+	3: {decodeFormatV3, verifyFormatV3},
+}
+
+// formatCodec decodes a version of the format, or verifies a repository
+// against it as described by VerifyAgainst
+type formatCodec struct {
+	decode func(br *bufio.Reader) (*Repository, error)
+	verify func(br *bufio.Reader, repo *Repository) (bool, error)
+}
+
+// formatHeaderSize is the size of the version and count written by WriteTo
+const formatHeaderSize = 5
+
+// gobVersion is the current version of the gob encoding. It should be
+// incremented whenever gobRepository changes incompatibly
+const gobVersion = 1
+
+// patchVersion is the current version of the patch format
+const patchVersion = 1
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// WriteTo writes the repository to w in a binary format that can be read by
+// NewRepositoryFrom. The layout is:
+//
+//	version   uint8
+//	count     uint32
+//	strings   [count]{length uint32, bytes [length]byte}
+//	mapped    uint32
+//	mapping   [mapped]uint32
+//	checksum  uint32
+//
+// All integers are little-endian. The mapping is the one returned by
+// OriginalIDMapping, and is empty if there isn't one. The checksum is the
+// CRC-32 (IEEE) of the preceding bytes. Strings are written in order of
+// ID, streamed directly from the repository through a small fixed-size
+// buffer, so memory use doesn't depend on the size of the repository
+func (repo *Repository) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	crc := crc32.NewIEEE()
+	mw := io.MultiWriter(bw, crc)
+	var buf [formatHeaderSize]byte
+	buf[0] = formatVersion
+	binary.LittleEndian.PutUint32(buf[1:], repo.Count())
+	if _, err := mw.Write(buf[:]); err != nil {
+		return cw.n, err
+	}
+	cursor := repo.Cursor()
+	for cursor.Next() {
+		str := cursor.bytes()
+		binary.LittleEndian.PutUint32(buf[:4], uint32(len(str)))
+		if _, err := mw.Write(buf[:4]); err != nil {
+			return cw.n, err
+		}
+		if _, err := mw.Write(str); err != nil {
+			return cw.n, err
+		}
+	}
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(repo.originalIDs)))
+	if _, err := mw.Write(buf[:4]); err != nil {
+		return cw.n, err
+	}
+	for _, id := range repo.originalIDs {
+		binary.LittleEndian.PutUint32(buf[:4], id)
+		if _, err := mw.Write(buf[:4]); err != nil {
+			return cw.n, err
+		}
+	}
+	binary.LittleEndian.PutUint32(buf[:4], crc.Sum32())
+	if _, err := bw.Write(buf[:4]); err != nil {
+		return cw.n, err
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Offset returns the offset and length of the bytes of the string associated
+// with an ID within the output of WriteTo, or false if the ID does not exist.
+// It walks the strings preceding the ID, so it's O(id)
+func (repo *Repository) Offset(id uint32) (offset uint64, length uint32, ok bool) {
+	n, ok := repo.LenByID(id)
+	if !ok {
+		return 0, 0, false
+	}
+	offset = formatHeaderSize
+	for prev := uint32(1); prev < id; prev++ {
+		prevLength, _ := repo.LenByID(prev)
+		offset += 4 + uint64(prevLength)
+	}
+	return offset + 4, uint32(n), true
+}
+
+// NewRepositoryFrom creates a new string repository from the output of
+// WriteTo. Older versions of the format are still supported; they're
+// upgraded transparently, so writing the repository back out produces the
+// current version. It returns an error wrapping ErrUnsupportedVersion, with
+// the version in its Version field, if the input was written by a newer
+// version of this package, and ErrInvalidFormat or io.ErrUnexpectedEOF if
+// the input is malformed or truncated. Reading stops after the declared
+// number of strings and checksum, so trailing bytes (e.g. padding from
+// block-aligned storage) are ignored
+func NewRepositoryFrom(r io.Reader) (*Repository, error) {
+	br := bufio.NewReader(r)
+	version, err := br.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if version == 0 {
+		return nil, ErrInvalidFormat
+	} else if int(version) >= len(formatCodecs) {
+		return nil, unsupportedVersion(int(version))
+	}
+	return formatCodecs[version].decode(br)
+}
+
+// decodeFormatV1 decodes version 1 of the format, which has no checksum
+func decodeFormatV1(br *bufio.Reader) (*Repository, error) {
+	return decodeStrings(br)
+}
+
+// decodeFormatV2 decodes version 2 of the format, which adds a checksum
+func decodeFormatV2(br *bufio.Reader) (*Repository, error) {
+	return decodeChecksummed(br, 2, false)
+}
+
+// decodeFormatV3 decodes version 3 of the format, which adds the ID mapping
+func decodeFormatV3(br *bufio.Reader) (*Repository, error) {
+	return decodeChecksummed(br, 3, true)
+}
+
+// decodeChecksummed decodes a version of the format that ends with a
+// checksum, and optionally has an ID mapping after the strings
+func decodeChecksummed(br *bufio.Reader, version byte, hasMapping bool) (*Repository, error) {
+	crc := crc32.NewIEEE()
+	crc.Write([]byte{version})
+	r := io.TeeReader(br, crc)
+	repo, err := decodeStrings(r)
+	if err != nil {
+		return nil, err
+	}
+	if hasMapping {
+		if repo.originalIDs, err = decodeMapping(r, repo.count); err != nil {
+			return nil, err
+		}
+	}
+	var buf [4]byte
+	if _, err := io.ReadFull(br, buf[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if binary.LittleEndian.Uint32(buf[:]) != crc.Sum32() {
+		return nil, ErrInvalidFormat
+	}
+	return repo, nil
+}
+
+// decodeMapping decodes an ID mapping to a repository with count strings.
+// It returns nil if the mapping is empty
+func decodeMapping(r io.Reader, count uint32) ([]uint32, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	mapped := binary.LittleEndian.Uint32(buf[:])
+	if mapped == 0 {
+		return nil, nil
+	}
+	var mapping []uint32
+	for i := uint32(0); i < mapped; i++ {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		id := binary.LittleEndian.Uint32(buf[:])
+		if id > count {
+			return nil, ErrInvalidFormat
+		}
+		mapping = append(mapping, id)
+	}
+	return mapping, nil
+}
+
+// decodeStrings decodes the count and strings written by WriteTo
+func decodeStrings(r io.Reader) (*Repository, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	count := binary.LittleEndian.Uint32(buf[:])
+
+	repo := NewRepository()
+	for id := uint32(1); id <= count; id++ {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		length := binary.LittleEndian.Uint32(buf[:])
+		if uint64(length) >= pageSize {
+			return nil, ErrInvalidFormat
+		}
+		str := make([]byte, length)
+		if _, err := io.ReadFull(r, str); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if internedID, err := repo.TryIntern(string(str)); err != nil {
+			return nil, err
+		} else if internedID != id {
+			return nil, ErrInvalidFormat
+		}
+	}
+	return repo, nil
+}
+
+// VerifyAgainst reports whether the repository matches the output of
+// WriteTo read from r, i.e. whether decoding it would produce an equal
+// repository with the same ID mapping. The input is streamed and compared
+// entry by entry without being loaded into a second repository, and
+// reading stops at the first mismatch. Errors are returned as by
+// NewRepositoryFrom; a checksum mismatch is only detected if everything
+// else matches
+func (repo *Repository) VerifyAgainst(r io.Reader) (bool, error) {
+	br := bufio.NewReader(r)
+	version, err := br.ReadByte()
+	if err != nil {
+		return false, unexpectedEOF(err)
+	}
+	if version == 0 {
+		return false, ErrInvalidFormat
+	} else if int(version) >= len(formatCodecs) {
+		return false, unsupportedVersion(int(version))
+	}
+	return formatCodecs[version].verify(br, repo)
+}
+
+// verifyFormatV1 verifies a repository against version 1 of the format
+func verifyFormatV1(br *bufio.Reader, repo *Repository) (bool, error) {
+	return verifyStrings(br, repo)
+}
+
+// verifyFormatV2 verifies a repository against version 2 of the format
+func verifyFormatV2(br *bufio.Reader, repo *Repository) (bool, error) {
+	return verifyChecksummed(br, repo, 2, false)
+}
+
+// verifyFormatV3 verifies a repository against version 3 of the format
+func verifyFormatV3(br *bufio.Reader, repo *Repository) (bool, error) {
+	return verifyChecksummed(br, repo, 3, true)
+}
+
+// verifyChecksummed verifies a repository against a version of the format
+// read by decodeChecksummed
+func verifyChecksummed(br *bufio.Reader, repo *Repository, version byte, hasMapping bool) (bool, error) {
+	crc := crc32.NewIEEE()
+	crc.Write([]byte{version})
+	r := io.TeeReader(br, crc)
+	if ok, err := verifyStrings(r, repo); !ok || err != nil {
+		return ok, err
+	}
+	if hasMapping {
+		mapping, err := decodeMapping(r, repo.Count())
+		if err != nil {
+			return false, err
+		}
+		if len(mapping) != len(repo.originalIDs) {
+			return false, nil
+		}
+		for i := range mapping {
+			if mapping[i] != repo.originalIDs[i] {
+				return false, nil
+			}
+		}
+	}
+	var buf [4]byte
+	if _, err := io.ReadFull(br, buf[:]); err != nil {
+		return false, unexpectedEOF(err)
+	}
+	if binary.LittleEndian.Uint32(buf[:]) != crc.Sum32() {
+		return false, ErrInvalidFormat
+	}
+	return true, nil
+}
+
+// verifyStrings compares the count and strings read by decodeStrings with
+// the repository, stopping at the first mismatch
+func verifyStrings(r io.Reader, repo *Repository) (bool, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return false, unexpectedEOF(err)
+	}
+	count := binary.LittleEndian.Uint32(buf[:])
+	if count != repo.Count() {
+		return false, nil
+	}
+	var expected, actual []byte
+	for id := uint32(1); id <= count; id++ {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return false, unexpectedEOF(err)
+		}
+		length := binary.LittleEndian.Uint32(buf[:])
+		if uint64(length) >= pageSize {
+			return false, ErrInvalidFormat
+		}
+		expected, _ = repo.LookupIDBytesInto(id, expected[:0])
+		if len(expected) != int(length) {
+			return false, nil
+		}
+		if cap(actual) < int(length) {
+			actual = make([]byte, length)
+		}
+		actual = actual[:length]
+		if _, err := io.ReadFull(r, actual); err != nil {
+			return false, unexpectedEOF(err)
+		}
+		if !bytes.Equal(expected, actual) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+type gobRepository struct {
+	Version uint32
+	Strings []string
+}
+
+// EncodeGob encodes the repository to a gob stream. The encoding is
+// versioned so that it can be decoded by future versions of this package
+func (repo *Repository) EncodeGob(enc *gob.Encoder) error {
+	value := gobRepository{
+		Version: gobVersion,
+		Strings: make([]string, 0, repo.Count()),
+	}
+	cursor := repo.Cursor()
+	for cursor.Next() {
+		value.Strings = append(value.Strings, cursor.String())
+	}
+	return enc.Encode(&value)
+}
+
+// DecodeGob decodes a repository encoded by EncodeGob into the receiver,
+// which must be empty. It returns an error wrapping ErrUnsupportedVersion,
+// with the version, if the stream was encoded with a newer version of the
+// format
+func (repo *Repository) DecodeGob(dec *gob.Decoder) error {
+	var value gobRepository
+	if err := dec.Decode(&value); err != nil {
+		return err
+	}
+	if value.Version > gobVersion {
+		return unsupportedVersion(int(value.Version))
+	}
+	if repo.Count() != 0 {
+		return ErrNotEmpty
+	}
+	for _, str := range value.Strings {
+		if _, err := repo.intern(str); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type jsonlEntry struct {
+	ID  uint32 `json:"id"`
+	Str string `json:"s"`
+}
+
+// WriteJSONL writes the strings in the repository to w as newline-delimited
+// JSON, one {"id":N,"s":"..."} object per line in order of ID. The strings
+// are streamed, so memory use doesn't grow with the repository. Invalid
+// UTF-8 is replaced with U+FFFD, as with encoding/json
+func (repo *Repository) WriteJSONL(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	cursor := repo.Cursor()
+	for cursor.Next() {
+		if err := enc.Encode(jsonlEntry{ID: cursor.ID(), Str: cursor.String()}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// SnapshotPatch returns a patch containing the strings added to the
+// repository between two snapshots, which can be applied to a replica of
+// the repository at the first snapshot using ApplyPatch. It returns
+// ErrInvalidSnapshot if either snapshot is no longer valid or if the
+// snapshots are out of order. The patch layout is:
+//
+//	version   uint8
+//	base      uint32
+//	count     uint32
+//	strings   [count]{length uint32, bytes [length]byte}
+//
+// where base is the number of strings in the repository at the first
+// snapshot. All integers are little-endian
+func (repo *Repository) SnapshotPatch(from, to *Snapshot) ([]byte, error) {
+	if !repo.valid(from) || !repo.valid(to) || from.count > to.count {
+		return nil, ErrInvalidSnapshot
+	}
+	patch := make([]byte, 9)
+	patch[0] = patchVersion
+	binary.LittleEndian.PutUint32(patch[1:], from.count)
+	binary.LittleEndian.PutUint32(patch[5:], to.count-from.count)
+	var length [4]byte
+	for id := from.count + 1; id <= to.count; id++ {
+		str, _ := repo.LookupID(id)
+		binary.LittleEndian.PutUint32(length[:], uint32(len(str)))
+		patch = append(patch, length[:]...)
+		patch = append(patch, str...)
+	}
+	return patch, nil
+}
+
+// ApplyPatch applies a patch created by SnapshotPatch. The repository must
+// contain the same number of strings as the source repository did when the
+// patch was taken, otherwise ErrPatchOutOfOrder is returned. If the patch
+// can't be applied the repository is left unchanged
+func (repo *Repository) ApplyPatch(patch []byte) error {
+	if len(patch) < 9 {
+		return ErrInvalidPatch
+	}
+	if patch[0] == 0 {
+		return ErrInvalidPatch
+	} else if patch[0] > patchVersion {
+		return unsupportedVersion(int(patch[0]))
+	}
+	base := binary.LittleEndian.Uint32(patch[1:])
+	count := binary.LittleEndian.Uint32(patch[5:])
+	if base != repo.Count() {
+		return ErrPatchOutOfOrder
+	}
+
+	strs := make([]string, 0, count)
+	rest := patch[9:]
+	for i := uint32(0); i < count; i++ {
+		if len(rest) < 4 {
+			return ErrInvalidPatch
+		}
+		length := binary.LittleEndian.Uint32(rest)
+		rest = rest[4:]
+		if uint64(len(rest)) < uint64(length) {
+			return ErrInvalidPatch
+		}
+		strs = append(strs, string(rest[:length]))
+		rest = rest[length:]
+	}
+	if len(rest) != 0 {
+		return ErrInvalidPatch
+	}
+
+	snapshot := repo.Snapshot()
+	for i, str := range strs {
+		id, err := repo.intern(str)
+		if err == nil && id != base+uint32(i)+1 {
+			err = ErrInvalidPatch
+		}
+		if err != nil {
+			repo.Restore(snapshot)
+			return err
+		}
+	}
+	return nil
+}
+
+// SetLogWriter sets a writer that each newly interned string is appended
+// to, for use as a write-ahead log of the repository. Strings that are
+// already in the repository aren't logged. Each entry is written as:
+//
+//	id        uint32
+//	length    uint32
+//	bytes     [length]byte
+//
+// Operations that remove strings are logged too, so that replaying the log
+// reproduces the exact mapping. They're logged as a truncate entry, which
+// has an ID of 0 and the number of strings that remain in place of the
+// length, with no bytes. Restore logs a truncate entry, while operations
+// that rebuild the repository, such as Retain and OptimizeInPlace, log a
+// truncate entry with a count of 0 followed by an entry for every string
+// in the rebuilt repository.
+//
+// The log can be replayed with ReplayLog. If a write fails, logging stops
+// and the error is reported by LogError. A nil writer disables logging
+func (repo *Repository) SetLogWriter(w io.Writer) {
+	repo.log = w
+	repo.logErr = nil
+}
+
+// LogError returns the first error encountered writing to the writer set
+// by SetLogWriter, if any
+func (repo *Repository) LogError() error {
+	return repo.logErr
+}
+
+// logTruncate is the ID of log entries that record strings being removed
+const logTruncate = 0
+
+func (repo *Repository) writeLog(id uint32, str string) {
+	repo.writeLogEntry(id, uint32(len(str)), str)
+}
+
+func (repo *Repository) writeLogTruncate(count uint32) {
+	repo.writeLogEntry(logTruncate, count, "")
+}
+
+func (repo *Repository) writeLogEntry(id, length uint32, str string) {
+	if repo.logErr != nil {
+		return
+	}
+	entry := make([]byte, 8+len(str))
+	binary.LittleEndian.PutUint32(entry, id)
+	binary.LittleEndian.PutUint32(entry[4:], length)
+	copy(entry[8:], str)
+	if _, err := repo.log.Write(entry); err != nil {
+		repo.logErr = err
+	}
+}
+
+// logRebuild logs a rebuild of the repository, after which its strings may
+// have been removed or renumbered
+func (repo *Repository) logRebuild() {
+	repo.writeLogTruncate(0)
+	cursor := repo.Cursor()
+	for cursor.Next() {
+		repo.writeLog(cursor.At())
+	}
+}
+
+// ReplayLog interns each string in a log written by SetLogWriter, and
+// removes strings where the log records that they were removed. Each string
+// must be assigned the ID it was logged with, otherwise ErrInvalidFormat is
+// returned. Entries for strings that are already in the repository with the
+// same ID are skipped, so a log can be replayed on top of a repository that
+// was restored from an earlier copy. Strings are removed as with
+// TrimToCount, which invalidates all snapshots
+func (repo *Repository) ReplayLog(r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		expected, length, str, err := readLogEntry(br)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if expected == logTruncate {
+			if err := repo.replayTruncate(length); err != nil {
+				return err
+			}
+			continue
+		}
+		id, err := repo.intern(str)
+		if err != nil {
+			return err
+		}
+		if id != expected {
+			return ErrInvalidFormat
+		}
+	}
+}
+
+// NewRepositoryFromLog creates a new string repository by replaying a log
+// written by SetLogWriter to an empty repository. The IDs in the log must
+// be contiguous from 1, otherwise ErrInvalidFormat is returned. A torn final
+// entry, e.g. from a crash mid-write, is ignored, and the repository is
+// returned with the strings from each complete entry
+func NewRepositoryFromLog(r io.Reader) (*Repository, error) {
+	br := bufio.NewReader(r)
+	repo := NewRepository()
+	for {
+		expected, length, str, err := readLogEntry(br)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return repo, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if expected == logTruncate {
+			if err := repo.replayTruncate(length); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if expected != repo.Count()+1 {
+			return nil, ErrInvalidFormat
+		}
+		if id, err := repo.intern(str); err != nil {
+			return nil, err
+		} else if id != expected {
+			return nil, ErrInvalidFormat
+		}
+	}
+}
+
+// replayTruncate applies a truncate entry from a log
+func (repo *Repository) replayTruncate(count uint32) error {
+	if count > repo.Count() {
+		return ErrInvalidFormat
+	}
+	return repo.TrimToCount(count)
+}
+
+// readLogEntry reads an entry written by writeLogEntry. For a truncate
+// entry, length is the number of strings that remain. It returns io.EOF if
+// there are no more entries, and io.ErrUnexpectedEOF if the entry is
+// truncated
+func readLogEntry(br *bufio.Reader) (id, length uint32, str string, err error) {
+	var header [8]byte
+	if n, err := io.ReadFull(br, header[:]); err != nil {
+		if n > 0 {
+			return 0, 0, "", unexpectedEOF(err)
+		}
+		return 0, 0, "", err
+	}
+	id = binary.LittleEndian.Uint32(header[:])
+	length = binary.LittleEndian.Uint32(header[4:])
+	if id == logTruncate {
+		return id, length, "", nil
+	}
+	if uint64(length) >= pageSize {
+		return 0, 0, "", ErrInvalidFormat
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return 0, 0, "", unexpectedEOF(err)
+	}
+	return id, length, string(buf), nil
+}
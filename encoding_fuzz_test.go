@@ -0,0 +1,38 @@
+//go:build go1.18
+// +build go1.18
+
+package intern
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func FuzzRepositoryRoundTrip(f *testing.F) {
+	f.Add("")
+	f.Add("foo\x00bar\x00foo")
+	f.Add("\x00\x00héllo\x00wörld\x00日本語")
+	f.Add(strings.Repeat("x", int(NewRepository().PageSize())-1))
+
+	f.Fuzz(func(t *testing.T, input string) {
+		// strings can't contain NUL bytes, so use them as a separator
+		repo := NewRepository()
+		for _, str := range strings.Split(input, "\x00") {
+			// skip strings that are too large to intern
+			repo.TryIntern(str)
+		}
+
+		var buf bytes.Buffer
+		if _, err := repo.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := NewRepositoryFrom(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !decoded.Equal(repo) {
+			t.Error("decoded repository is not equal")
+		}
+	})
+}
@@ -0,0 +1,596 @@
+package intern
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestWriteJSONL(t *testing.T) {
+	repo := NewRepository()
+	strs := []string{"foo", `say "hi"\n`, "héllo, 世界", "", "<tag> & \t"}
+	for _, str := range strs {
+		repo.Intern(str)
+	}
+
+	var buf bytes.Buffer
+	if err := repo.WriteJSONL(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+	if len(lines) != len(strs) {
+		t.Fatalf("expected %d lines, got %d", len(strs), len(lines))
+	}
+	for i, line := range lines {
+		var entry struct {
+			ID  uint32 `json:"id"`
+			Str string `json:"s"`
+		}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		if entry.ID != uint32(i+1) || entry.Str != strs[i] {
+			t.Errorf("line %d: expected %d %q, got %d %q", i, i+1, strs[i], entry.ID, entry.Str)
+		}
+	}
+
+	if err := repo.WriteJSONL(failingWriter{}); err == nil {
+		t.Error("expected a write error")
+	}
+}
+
+func TestGobRoundTrip(t *testing.T) {
+	repo := NewRepository()
+	for _, str := range []string{"foo", "bar", "qux"} {
+		repo.Intern(str)
+	}
+
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := repo.EncodeGob(enc); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode("trailer"); err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := append([]byte(nil), buf.Bytes()...)
+	dec := gob.NewDecoder(&buf)
+	decoded := NewRepository()
+	if err := decoded.DecodeGob(dec); err != nil {
+		t.Fatal(err)
+	}
+	assertStrings(t, decoded, []string{"foo", "bar", "qux"})
+	var trailer string
+	if err := dec.Decode(&trailer); err != nil || trailer != "trailer" {
+		t.Error("gob stream was not left at the next value")
+	}
+
+	if err := decoded.DecodeGob(gob.NewDecoder(bytes.NewReader(encoded))); err != ErrNotEmpty {
+		t.Errorf("expected ErrNotEmpty, got %v", err)
+	}
+}
+
+func TestGobUnsupportedVersion(t *testing.T) {
+	var buf bytes.Buffer
+	value := gobRepository{Version: gobVersion + 1, Strings: []string{"foo"}}
+	if err := gob.NewEncoder(&buf).Encode(&value); err != nil {
+		t.Fatal(err)
+	}
+	repo := NewRepository()
+	err := repo.DecodeGob(gob.NewDecoder(&buf))
+	var e *Error
+	if !errors.Is(err, ErrUnsupportedVersion) || !errors.As(err, &e) || e.Version != gobVersion+1 {
+		t.Errorf("expected ErrUnsupportedVersion with the version, got %v", err)
+	}
+	if repo.Count() != 0 {
+		t.Error("unexpected strings in repository")
+	}
+}
+
+func TestSnapshotPatch(t *testing.T) {
+	repo := NewRepository()
+	replica := NewRepository()
+	repo.Intern("foo")
+	replica.Intern("foo")
+
+	first := repo.Snapshot()
+	repo.Intern("bar")
+	repo.Intern("")
+	second := repo.Snapshot()
+	repo.Intern("qux")
+	third := repo.Snapshot()
+
+	patch1, err := repo.SnapshotPatch(first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch2, err := repo.SnapshotPatch(second, third)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.SnapshotPatch(third, first); err != ErrInvalidSnapshot {
+		t.Error("expected ErrInvalidSnapshot for out of order snapshots")
+	}
+
+	if err := replica.ApplyPatch(patch2); err != ErrPatchOutOfOrder {
+		t.Error("expected ErrPatchOutOfOrder")
+	}
+	if err := replica.ApplyPatch(patch1); err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.ApplyPatch(patch2); err != nil {
+		t.Fatal(err)
+	}
+	assertStrings(t, replica, []string{"foo", "bar", "", "qux"})
+
+	if err := repo.Restore(first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.SnapshotPatch(first, second); err != ErrInvalidSnapshot {
+		t.Error("expected ErrInvalidSnapshot after restore")
+	}
+}
+
+func TestApplyPatchInvalid(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	from := repo.Snapshot()
+	repo.Intern("bar")
+	repo.Intern("foo2")
+	patch, err := repo.SnapshotPatch(from, repo.Snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replica := NewRepository()
+	replica.Intern("foo")
+	if err := replica.ApplyPatch(patch[:len(patch)-1]); err != ErrInvalidPatch {
+		t.Error("expected ErrInvalidPatch for a truncated patch")
+	}
+
+	// a replica that diverged from the source
+	replica = NewRepository()
+	replica.Intern("bar")
+	if err := replica.ApplyPatch(patch); err != ErrInvalidPatch {
+		t.Error("expected ErrInvalidPatch for a conflicting patch")
+	}
+	assertStrings(t, replica, []string{"bar"})
+
+	replica = NewRepository()
+	replica.Intern("foo")
+	zeroed := append([]byte(nil), patch...)
+	zeroed[0] = 0
+	if err := replica.ApplyPatch(zeroed); err != ErrInvalidPatch {
+		t.Errorf("expected ErrInvalidPatch for version 0, got %v", err)
+	}
+	future := append([]byte(nil), patch...)
+	future[0] = patchVersion + 1
+	err = replica.ApplyPatch(future)
+	var e *Error
+	if !errors.Is(err, ErrUnsupportedVersion) || !errors.As(err, &e) || e.Version != patchVersion+1 {
+		t.Errorf("expected ErrUnsupportedVersion with the version, got %v", err)
+	}
+	assertStrings(t, replica, []string{"foo"})
+}
+
+func TestWriteTo(t *testing.T) {
+	repo := NewRepository()
+	for _, str := range []string{"foo", "", "bar", "héllo wörld"} {
+		repo.Intern(str)
+	}
+	var buf bytes.Buffer
+	n, err := repo.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Error("invalid WriteTo() byte count")
+	}
+	decoded, err := NewRepositoryFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(repo) {
+		t.Error("decoded repository is not equal")
+	}
+}
+
+func TestNewRepositoryFromInvalid(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	repo.Intern("bar")
+	var buf bytes.Buffer
+	if _, err := repo.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	if _, err := NewRepositoryFrom(bytes.NewReader(data[:len(data)-1])); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	if _, err := NewRepositoryFrom(bytes.NewReader(nil)); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	// the same string twice
+	duplicate := append([]byte(nil), data...)
+	copy(duplicate[bytes.LastIndex(data, []byte("bar")):], "foo")
+	if _, err := NewRepositoryFrom(bytes.NewReader(duplicate)); err != ErrInvalidFormat {
+		t.Errorf("expected ErrInvalidFormat, got %v", err)
+	}
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[bytes.LastIndex(data, []byte("bar"))] ^= 1
+	if _, err := NewRepositoryFrom(bytes.NewReader(corrupt)); err != ErrInvalidFormat {
+		t.Errorf("expected ErrInvalidFormat for a bad checksum, got %v", err)
+	}
+}
+
+func TestNewRepositoryFromVersions(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	repo.Intern("bar")
+	var buf bytes.Buffer
+	if _, err := repo.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	current := buf.Bytes()
+	if current[0] != formatVersion {
+		t.Fatalf("expected WriteTo() to write version %d", formatVersion)
+	}
+	if decoded, err := NewRepositoryFrom(bytes.NewReader(current)); err != nil || !decoded.Equal(repo) {
+		t.Errorf("failed to decode the current version: %v", err)
+	}
+
+	v1 := []byte{1, 2, 0, 0, 0, 3, 0, 0, 0, 'f', 'o', 'o', 3, 0, 0, 0, 'b', 'a', 'r'}
+	decoded, err := NewRepositoryFrom(bytes.NewReader(v1))
+	if err != nil || !decoded.Equal(repo) {
+		t.Fatalf("failed to decode version 1: %v", err)
+	}
+	var upgraded bytes.Buffer
+	if _, err := decoded.WriteTo(&upgraded); err != nil || !bytes.Equal(upgraded.Bytes(), current) {
+		t.Error("expected version 1 to be upgraded to the current version")
+	}
+
+	v2 := append([]byte{2}, v1[1:]...)
+	var checksum [4]byte
+	binary.LittleEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(v2))
+	v2 = append(v2, checksum[:]...)
+	if decoded, err := NewRepositoryFrom(bytes.NewReader(v2)); err != nil || !decoded.Equal(repo) {
+		t.Errorf("failed to decode version 2: %v", err)
+	}
+
+	for version, data := range map[int][]byte{1: v1, 2: v2, formatVersion: current} {
+		if ok, err := repo.VerifyAgainst(bytes.NewReader(data)); !ok || err != nil {
+			t.Errorf("failed to verify version %d: %v, %v", version, ok, err)
+		}
+	}
+
+	future := append([]byte{formatVersion + 1}, current[1:]...)
+	_, err = NewRepositoryFrom(bytes.NewReader(future))
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.Version != formatVersion+1 {
+		t.Error("expected the unsupported version number")
+	}
+}
+
+func TestOffset(t *testing.T) {
+	repo := NewRepository()
+	strs := []string{"foo", "", "héllo", "bar"}
+	for _, str := range strs {
+		repo.Intern(str)
+	}
+	var buf bytes.Buffer
+	if _, err := repo.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	for i, str := range strs {
+		offset, length, ok := repo.Offset(uint32(i + 1))
+		if !ok || int(length) != len(str) {
+			t.Fatalf("invalid Offset() result for id %d", i+1)
+		}
+		if string(data[offset:offset+uint64(length)]) != str {
+			t.Errorf("invalid Offset() result for id %d", i+1)
+		}
+	}
+	if _, _, ok := repo.Offset(5); ok {
+		t.Error("invalid Offset() result")
+	}
+	if _, _, ok := repo.Offset(0); ok {
+		t.Error("invalid Offset() result")
+	}
+}
+
+func TestNewRepositoryFromPadding(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	repo.Intern("bar")
+	var buf bytes.Buffer
+	if _, err := repo.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	padded := append(append([]byte(nil), data...), make([]byte, 512-len(data))...)
+	decoded, err := NewRepositoryFrom(bytes.NewReader(padded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(repo) {
+		t.Error("decoded repository is not equal")
+	}
+
+	for i := 1; i < len(data); i++ {
+		if _, err := NewRepositoryFrom(bytes.NewReader(data[:i])); err != io.ErrUnexpectedEOF {
+			t.Errorf("expected io.ErrUnexpectedEOF when truncated to %d bytes, got %v", i, err)
+		}
+	}
+}
+
+func TestWriteToLarge(t *testing.T) {
+	build := func(count int) *Repository {
+		repo := NewRepository()
+		for i := 0; i < count; i++ {
+			repo.Intern(fmt.Sprintf("string %d", i))
+		}
+		return repo
+	}
+	small, large := build(100), build(100000)
+
+	var buf bytes.Buffer
+	if _, err := large.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := NewRepositoryFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(large) {
+		t.Error("decoded repository is not equal")
+	}
+
+	allocs := func(repo *Repository) float64 {
+		return testing.AllocsPerRun(50, func() {
+			repo.WriteTo(ioutil.Discard)
+		})
+	}
+	if smallAllocs, largeAllocs := allocs(small), allocs(large); largeAllocs != smallAllocs {
+		t.Errorf("WriteTo() allocations grow with the repository: %v vs %v", largeAllocs, smallAllocs)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrShortWrite
+}
+
+func TestLogWriter(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("before")
+	var log bytes.Buffer
+	repo.SetLogWriter(&log)
+	for _, str := range []string{"foo", "bar", "foo", "before", "", "qux", "bar"} {
+		repo.Intern(str)
+	}
+	if log.Len() != 4*8+len("foo")+len("bar")+len("qux") {
+		t.Errorf("expected only new strings to be logged, got %d bytes", log.Len())
+	}
+
+	replayed := NewRepository()
+	replayed.Intern("before")
+	data := log.Bytes()
+	if err := replayed.ReplayLog(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !replayed.Equal(repo) {
+		t.Error("replayed repository is not equal")
+	}
+	if err := replayed.ReplayLog(bytes.NewReader(data)); err != nil || !replayed.Equal(repo) {
+		t.Error("expected replaying the log again to be a no-op")
+	}
+
+	if err := NewRepository().ReplayLog(bytes.NewReader(data)); err != ErrInvalidFormat {
+		t.Errorf("expected ErrInvalidFormat for a log without its base, got %v", err)
+	}
+	partial := NewRepository()
+	partial.Intern("before")
+	if err := partial.ReplayLog(bytes.NewReader(data[:len(data)-1])); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	repo.SetLogWriter(failingWriter{})
+	repo.Intern("xyz")
+	repo.Intern("abc")
+	if repo.LogError() != io.ErrShortWrite || repo.Count() != 7 {
+		t.Error("expected a log error without failing interns")
+	}
+	repo.SetLogWriter(nil)
+	if repo.LogError() != nil {
+		t.Error("expected SetLogWriter() to reset the log error")
+	}
+}
+
+func TestNewRepositoryFromLog(t *testing.T) {
+	repo := NewRepository()
+	var log bytes.Buffer
+	repo.SetLogWriter(&log)
+	for _, str := range []string{"foo", "bar", "foo", "", "qux"} {
+		repo.Intern(str)
+	}
+	data := log.Bytes()
+
+	loaded, err := NewRepositoryFromLog(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equal(repo) {
+		t.Error("loaded repository is not equal")
+	}
+
+	for _, torn := range []int{1, 3, 8, 10} {
+		loaded, err := NewRepositoryFromLog(bytes.NewReader(data[:len(data)-torn]))
+		if err != nil {
+			t.Fatalf("torn by %d bytes: %v", torn, err)
+		}
+		assertStrings(t, loaded, []string{"foo", "bar", ""})
+	}
+	if loaded, err := NewRepositoryFromLog(bytes.NewReader(nil)); err != nil || loaded.Count() != 0 {
+		t.Error("expected an empty repository from an empty log")
+	}
+
+	var gap bytes.Buffer
+	other := NewRepository()
+	other.Intern("foo")
+	other.SetLogWriter(&gap)
+	other.Intern("bar")
+	if _, err := NewRepositoryFromLog(&gap); err != ErrInvalidFormat {
+		t.Errorf("expected ErrInvalidFormat for non-contiguous IDs, got %v", err)
+	}
+}
+
+func TestLogRemovals(t *testing.T) {
+	repo := NewRepository()
+	var log bytes.Buffer
+	repo.SetLogWriter(&log)
+	repo.InternAll([]string{"foo", "bar", "qux"})
+	snapshot := repo.Snapshot()
+	repo.InternAll([]string{"a", "b"})
+	repo.Restore(snapshot)
+	repo.InternAll([]string{"c", "d", "e"})
+	repo.Retain([]uint32{5, 1, 2, 4})
+	repo.Intern("f")
+	freq := NewFrequency()
+	freq.Add(4)
+	freq.Add(5)
+	repo.OptimizeInPlace(freq)
+	repo.TrimToCount(1)
+	snapshot = repo.Snapshot()
+	repo.Intern("g")
+	repo.CompactTo(snapshot)
+	repo.Intern("h")
+	if repo.LogError() != nil {
+		t.Fatal(repo.LogError())
+	}
+
+	data := log.Bytes()
+	loaded, err := NewRepositoryFromLog(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equal(repo) {
+		t.Errorf("expected %v, got %v", repo.FirstN(10), loaded.FirstN(10))
+	}
+	replayed := NewRepository()
+	if err := replayed.ReplayLog(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !replayed.Equal(repo) {
+		t.Errorf("expected %v, got %v", repo.FirstN(10), replayed.FirstN(10))
+	}
+
+	var truncate [8]byte
+	binary.LittleEndian.PutUint32(truncate[4:], 1)
+	if _, err := NewRepositoryFromLog(bytes.NewReader(truncate[:])); err != ErrInvalidFormat {
+		t.Errorf("expected ErrInvalidFormat for a truncate past the end, got %v", err)
+	}
+}
+
+func TestWriteToOriginalIDMapping(t *testing.T) {
+	repo := NewRepository()
+	freq := NewFrequency()
+	for _, str := range []string{"foo", "bar", "qux", "bar", "qux", "qux"} {
+		freq.Add(repo.Intern(str))
+	}
+	if _, ok := repo.OriginalIDMapping(); ok {
+		t.Error("expected no mapping")
+	}
+	optimized, remap := repo.OptimizeWithMapping(freq)
+	assertStrings(t, optimized, []string{"qux", "bar", "foo"})
+	if len(remap) != 4 || remap[1] != 3 || remap[2] != 2 || remap[3] != 1 {
+		t.Fatal("invalid OptimizeWithMapping() remap")
+	}
+
+	var buf bytes.Buffer
+	if _, err := optimized.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := NewRepositoryFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(optimized) {
+		t.Error("decoded repository is not equal")
+	}
+	mapping, ok := decoded.OriginalIDMapping()
+	if !ok || len(mapping) != len(remap) {
+		t.Fatal("expected the mapping to be preserved")
+	}
+	for i := range remap {
+		if mapping[i] != remap[i] {
+			t.Errorf("invalid mapping for original ID %d", i)
+		}
+	}
+
+	buf.Reset()
+	if _, err := repo.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err := NewRepositoryFrom(&buf); err != nil {
+		t.Fatal(err)
+	} else if _, ok := decoded.OriginalIDMapping(); ok {
+		t.Error("expected no mapping")
+	}
+}
+
+func TestVerifyAgainst(t *testing.T) {
+	repo := NewRepository()
+	for _, str := range []string{"foo", "", "bar", "héllo"} {
+		repo.Intern(str)
+	}
+	var buf bytes.Buffer
+	if _, err := repo.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if ok, err := repo.VerifyAgainst(bytes.NewReader(data)); !ok || err != nil {
+		t.Errorf("expected a match, got %v, %v", ok, err)
+	}
+
+	tampered := append([]byte(nil), data...)
+	tampered[bytes.Index(tampered, []byte("bar"))] = 'c'
+	if ok, err := repo.VerifyAgainst(bytes.NewReader(tampered)); ok || err != nil {
+		t.Errorf("expected a mismatch, got %v, %v", ok, err)
+	}
+	// the mismatch short-circuits before the truncated checksum is read
+	if ok, err := repo.VerifyAgainst(bytes.NewReader(tampered[:len(tampered)-2])); ok || err != nil {
+		t.Errorf("expected a mismatch, got %v, %v", ok, err)
+	}
+
+	other := repo.Clone()
+	other.Intern("extra")
+	if ok, err := other.VerifyAgainst(bytes.NewReader(data)); ok || err != nil {
+		t.Errorf("expected a count mismatch, got %v, %v", ok, err)
+	}
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt)-1] ^= 1
+	if _, err := repo.VerifyAgainst(bytes.NewReader(corrupt)); err != ErrInvalidFormat {
+		t.Errorf("expected ErrInvalidFormat for a bad checksum, got %v", err)
+	}
+	if _, err := repo.VerifyAgainst(bytes.NewReader(data[:len(data)-1])); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
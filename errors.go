@@ -0,0 +1,89 @@
+package intern
+
+import "fmt"
+
+// Error is the type of the errors returned by this package. Use errors.Is
+// to check for a specific error, e.g. errors.Is(err, ErrStringTooLarge),
+// and errors.As to access the detail fields
+type Error struct {
+	msg string
+
+	// kind is the sentinel error this error is an instance of, or nil if
+	// this is a sentinel error
+	kind *Error
+
+	// Length is the length of the offending string, for ErrStringTooLarge
+	Length int
+
+	// Index is the index in the batch at which interning stopped, for
+	// ErrIDSpaceExhausted returned by batch interners and
+	// ErrDuplicateString
+	Index int
+
+	// String is the offending string, for ErrDuplicateString
+	String string
+
+	// Version is the unsupported version, for ErrUnsupportedVersion
+	// returned by NewRepositoryFrom
+	Version int
+}
+
+func newError(msg string) *Error {
+	return &Error{msg: msg}
+}
+
+func (err *Error) Error() string {
+	return err.msg
+}
+
+// Is reports whether err is an instance of the target sentinel error
+func (err *Error) Is(target error) bool {
+	return err.kind != nil && error(err.kind) == target
+}
+
+// ErrStringTooLarge is returned when a string does not fit in one page.
+// The returned *Error's Length field holds the length of the string
+var ErrStringTooLarge = newError("string too large")
+
+func stringTooLarge(length int) error {
+	return &Error{
+		msg:    fmt.Sprintf("string too large: %d bytes", length),
+		kind:   ErrStringTooLarge,
+		Length: length,
+	}
+}
+
+// ErrIDSpaceExhausted is returned when a new string can't be interned
+// because all uint32 IDs are in use. Batch interners return an *Error whose
+// Index field holds the index of the string they stopped at
+var ErrIDSpaceExhausted = newError("ID space exhausted")
+
+func idSpaceExhausted(index int) error {
+	return &Error{
+		msg:   fmt.Sprintf("ID space exhausted at index %d", index),
+		kind:  ErrIDSpaceExhausted,
+		Index: index,
+	}
+}
+
+func unsupportedVersion(version int) error {
+	return &Error{
+		msg:     fmt.Sprintf("unsupported version %d", version),
+		kind:    ErrUnsupportedVersion,
+		Version: version,
+	}
+}
+
+// ErrDuplicateString is returned by InternAllStrict when a string is
+// already in the repository or repeated in the batch. The returned
+// *Error's Index and String fields hold the offending index and string
+var ErrDuplicateString = newError("duplicate string")
+
+func duplicateString(index int, str string) error {
+	return &Error{
+		msg:    fmt.Sprintf("duplicate string %q at index %d", str, index),
+		kind:   ErrDuplicateString,
+		Index:  index,
+		String: str,
+	}
+}
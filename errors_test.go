@@ -0,0 +1,116 @@
+package intern
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestErrorsIs(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    func() error
+		target error
+	}{
+		{"ErrInvalidSnapshot", func() error {
+			snapshot := NewRepository().Snapshot()
+			return NewRepository().Restore(snapshot)
+		}, ErrInvalidSnapshot},
+		{"ErrOutOfMemory", func() error {
+			repo := NewRepository()
+			allocFailN = 1
+			defer func() { allocFailN = 0 }()
+			_, err := repo.TryIntern("foo")
+			return err
+		}, ErrOutOfMemory},
+		{"ErrStringTooLarge", func() error {
+			_, err := NewRepository().TryIntern(strings.Repeat("x", int(pageSize)))
+			return err
+		}, ErrStringTooLarge},
+		{"ErrIDSpaceExhausted", func() error {
+			defer func(id uint32) { maxID = id }(maxID)
+			maxID = 0
+			_, err := NewRepository().TryInternAll([]string{"foo"})
+			return err
+		}, ErrIDSpaceExhausted},
+		{"ErrDiverged", func() error {
+			repo := NewRepository()
+			repo.Intern("foo")
+			return repo.Append(NewRepository())
+		}, ErrDiverged},
+		{"ErrUnknownID", func() error {
+			_, err := NewRepository().LookupIDsInto([]uint32{1}, nil)
+			return err
+		}, ErrUnknownID},
+		{"ErrFrozen", func() error {
+			repo := NewRepository()
+			repo.Freeze()
+			_, err := repo.TryIntern("foo")
+			return err
+		}, ErrFrozen},
+		{"ErrControlCharacter", func() error {
+			repo := NewRepositoryWithOptions(Options{SanitizeControl: Reject})
+			_, err := repo.TryIntern("foo\n")
+			return err
+		}, ErrControlCharacter},
+		{"ErrEmptyString", func() error {
+			_, err := NewRepository().InternNonEmpty("")
+			return err
+		}, ErrEmptyString},
+		{"ErrInvalidCount", func() error {
+			return NewRepository().TrimToCount(1)
+		}, ErrInvalidCount},
+		{"ErrCapacityExceeded", func() error {
+			repo := NewRepository()
+			repo.SetByteLimit(1)
+			_, err := repo.TryIntern("foo")
+			return err
+		}, ErrCapacityExceeded},
+		{"ErrDuplicateString", func() error {
+			_, err := NewRepository().InternAllStrict([]string{"foo", "foo"})
+			return err
+		}, ErrDuplicateString},
+		{"ErrUnsupportedVersion", func() error {
+			_, err := NewRepositoryFrom(bytes.NewReader([]byte{formatVersion + 1, 0, 0, 0, 0}))
+			return err
+		}, ErrUnsupportedVersion},
+		{"ErrInvalidFormat", func() error {
+			_, err := NewRepositoryFrom(bytes.NewReader([]byte{0, 0, 0, 0, 0}))
+			return err
+		}, ErrInvalidFormat},
+	}
+	for _, test := range tests {
+		err := test.err()
+		if !errors.Is(err, test.target) {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+		if !errors.Is(fmt.Errorf("wrapped: %w", err), test.target) {
+			t.Errorf("%s: wrapped error does not match", test.name)
+		}
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Errorf("%s: expected an *Error", test.name)
+		}
+		for _, other := range tests {
+			if other.target != test.target && errors.Is(err, other.target) {
+				t.Errorf("%s: unexpectedly matches %s", test.name, other.name)
+			}
+		}
+	}
+}
+
+func TestErrorDetail(t *testing.T) {
+	err := stringTooLarge(10)
+	if err.Error() != "string too large: 10 bytes" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.Length != 10 {
+		t.Error("expected Length detail")
+	}
+	if errors.Is(ErrStringTooLarge, ErrOutOfMemory) {
+		t.Error("distinct sentinels should not match")
+	}
+}
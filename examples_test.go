@@ -1,6 +1,7 @@
 package intern_test
 
 import (
+	"expvar"
 	"fmt"
 
 	"github.com/chriso/go-intern"
@@ -133,3 +134,18 @@ func ExampleRepository_Restore() {
 	// String "foo" has id 1
 	// String "xyz" has id 2
 }
+
+func ExampleRepository_MemoryProfile() {
+	repo := intern.NewRepository()
+
+	// Strings are allocated outside of the Go heap, so publish the
+	// repository's memory usage for monitoring, e.g. at /debug/vars
+	expvar.Publish("intern", expvar.Func(func() interface{} {
+		inUse, pages := repo.MemoryProfile()
+		return map[string]interface{}{
+			"in_use_bytes": inUse,
+			"pages":        pages,
+			"strings":      repo.Count(),
+		}
+	}))
+}
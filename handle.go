@@ -0,0 +1,16 @@
+//go:build go1.23
+// +build go1.23
+
+package intern
+
+import "unique"
+
+// InternHandle interns a string and returns its unique ID along with a
+// canonical handle for the string from the unique package. Handles for
+// equal strings compare equal, so they can be used for cheap comparisons
+// in Go code alongside the compact ID. The handle is for the string as
+// stored, i.e. after normalization
+func (repo *Repository) InternHandle(str string) (uint32, unique.Handle[string]) {
+	id, stored := repo.internNormalized(str)
+	return id, unique.Make(stored)
+}
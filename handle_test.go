@@ -0,0 +1,37 @@
+//go:build go1.23
+// +build go1.23
+
+package intern
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInternHandle(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	id, handle := repo.InternHandle("bar")
+	if id != 2 || id != repo.Intern("bar") {
+		t.Error("invalid InternHandle() ID")
+	}
+	if handle.Value() != "bar" {
+		t.Error("invalid InternHandle() handle")
+	}
+	again, other := repo.InternHandle(string([]byte("bar")))
+	if again != id || other != handle {
+		t.Error("InternHandle() is not idempotent")
+	}
+	if _, fooHandle := repo.InternHandle("foo"); fooHandle == handle {
+		t.Error("handles for different strings should not be equal")
+	}
+
+	normalized := NewRepositoryWithOptions(Options{Normalize: strings.TrimSpace})
+	id, handle = normalized.InternHandle(" foo")
+	if again, other := normalized.InternHandle("foo"); again != id || other != handle {
+		t.Error("expected equal handles for strings with the same normalized form")
+	}
+	if handle.Value() != "foo" {
+		t.Errorf("expected a handle for the normalized string, got %q", handle.Value())
+	}
+}
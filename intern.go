@@ -43,78 +43,1054 @@
 // locking, e.g. https://golang.org/pkg/sync/#Mutex
 package intern
 
+// #include <string.h>
 // #include <intern/strings.h>
 // #include <intern/optimize.h>
+//
+// static bool cursor_skip(struct strings_cursor *cursor, int n) {
+//     for (; n > 0; n--) {
+//         if (!strings_cursor_next(cursor)) {
+//             return false;
+//         }
+//     }
+//     return true;
+// }
+//
+// static const char *cursor_at(const struct strings_cursor *cursor, uint32_t *id) {
+//     *id = strings_cursor_id(cursor);
+//     return strings_cursor_string(cursor);
+// }
 // #cgo LDFLAGS: -lintern
 import "C"
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"math/rand"
 	"runtime"
+	"sort"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
 )
 
 // ErrInvalidSnapshot is returned by Repository.Restore when the
 // repository and snapshot are incompatible
-var ErrInvalidSnapshot = fmt.Errorf("invalid snapshot")
+var ErrInvalidSnapshot = newError("invalid snapshot")
+
+// ErrOutOfMemory is returned by TryIntern when a string cannot be interned.
+// Methods that don't return an error panic with this value instead
+var ErrOutOfMemory = newError("out of memory")
+
+// ErrDiverged is returned by Repository.Append when the repository is not
+// a prefix of the other repository
+var ErrDiverged = newError("repositories have diverged")
+
+// ErrUnknownID is returned when an ID does not exist in the repository
+var ErrUnknownID = newError("unknown ID")
+
+// ErrFrozen is returned when modifying a repository after Freeze
+var ErrFrozen = newError("repository is frozen")
+
+// ErrControlCharacter is returned when interning a string containing
+// control characters into a repository with SanitizeControl set to Reject
+var ErrControlCharacter = newError("string contains control characters")
+
+// ErrEmptyString is returned by InternNonEmpty when the string is empty
+var ErrEmptyString = newError("empty string")
+
+// ErrInvalidCount is returned by TrimToCount when the repository has fewer
+// strings than the requested count
+var ErrInvalidCount = newError("invalid count")
+
+// ErrCapacityExceeded is returned when interning a new string would take
+// the repository past the limit set by SetByteLimit
+var ErrCapacityExceeded = newError("capacity exceeded")
 
 // Repository stores a collection of unique strings
 type Repository struct {
 	ptr *C.struct_strings
+
+	// restores tracks the points the repository was restored to, so that
+	// snapshot validity can be checked without calling Restore. See
+	// recordRestore
+	restores   []restorePoint
+	restoreSeq uint64
+
+	// epoch is incremented when the underlying strings are replaced by a
+	// rebuild, which invalidates all snapshots
+	epoch uint64
+
+	// meta holds per-string metadata, indexed by ID
+	meta []metadata
+
+	// growthThreshold and onGrowth are set by OnGrowthThreshold
+	growthThreshold uint64
+	onGrowth        func(current uint64)
+
+	opts Options
+
+	// mods is incremented whenever strings are added or removed, so that
+	// cursors can detect modification during iteration. count mirrors
+	// Count() so that new strings can be detected without a cgo call
+	mods  uint64
+	count uint32
+
+	// originalIDs maps IDs from before an optimization to IDs in this
+	// repository. It's set by OptimizeWithMapping and NewRepositoryFrom
+	originalIDs []uint32
+
+	// log and logErr are set by SetLogWriter
+	log    io.Writer
+	logErr error
+
+	// lookupCache is set if Options.LookupCacheSize is set. It's cleared
+	// when strings are removed, since their IDs may be reused
+	lookupCache *lookupCache
+
+	// stats is set if Options.Instrument is set
+	stats *callStats
+
+	// runeBuf is reused by InternRunes to encode runes as UTF-8
+	runeBuf []byte
+
+	// byteLimit is set by SetByteLimit; zero means no limit. pageUsed is
+	// an upper bound on the bytes used in the current page while there's a
+	// limit, or pageSize if it's unknown
+	byteLimit uint64
+	pageUsed  uint64
+
+	// borrowed is set if the repository doesn't own ptr. It's cleared by
+	// replace, which never frees a borrowed ptr
+	borrowed bool
+
+	debug  bool
+	frozen bool
+}
+
+// Options configures a repository created by NewRepositoryWithOptions.
+// Options only apply to that repository, not to repositories derived from
+// it, e.g. by Optimize
+type Options struct {
+	// Normalize, if set, is applied to strings before they're interned or
+	// looked up, so that strings with the same normalized form share an ID.
+	// strings.TrimSpace is a common choice. Strings are stored in their
+	// normalized form
+	Normalize func(string) string
+
+	// SanitizeControl controls how strings containing control characters
+	// are handled. It's applied after Normalize. The default is Allow
+	SanitizeControl SanitizeMode
+
+	// BatchCacheSize, if positive, makes InternAll and TryInternAll cache
+	// the IDs of up to this many recently interned strings for the
+	// duration of a batch, so that repeats skip the cgo call. It speeds up
+	// batches where most strings are repeats of a small hot set. The cache
+	// is cleared when it fills up
+	BatchCacheSize int
+
+	// LookupCacheSize, if positive, makes LookupID cache the Go strings of
+	// up to this many recently looked up IDs, so that repeated lookups of
+	// hot IDs return the same string rather than copying it from libintern
+	// and allocating each time. The least recently used string is evicted
+	// when the cache is full. The cache is locked, so lookups remain safe
+	// from multiple goroutines, but hot lookups contend on the lock
+	LookupCacheSize int
+
+	// Instrument enables counting of cgo calls, which are reported by
+	// CallStats. It's useful for finding unexpectedly hot cgo paths
+	Instrument bool
+}
+
+// SanitizeMode controls how control characters are handled when interning
+type SanitizeMode int
+
+const (
+	// Allow interns strings containing control characters unchanged
+	Allow SanitizeMode = iota
+	// Strip removes control characters before interning
+	Strip
+	// Reject refuses to intern strings containing control characters.
+	// TryIntern returns ErrControlCharacter and Intern panics with it
+	Reject
+)
+
+type metadata struct {
+	value uint64
+	set   bool
+}
+
+type restorePoint struct {
+	seq   uint64
+	count uint32
 }
 
 // NewRepository creates a new string repository
 func NewRepository() *Repository {
-	ptr := C.strings_new()
+	var ptr *C.struct_strings
+	if !allocFails() {
+		ptr = C.strings_new()
+	}
 	return newRepositoryFromPtr(ptr)
 }
 
+// MergeMany creates a new repository containing the strings from each of
+// the repositories, in order. It also returns a mapping from old IDs to new
+// IDs for each repository
+func MergeMany(repos ...*Repository) (*Repository, []map[uint32]uint32) {
+	merged := NewRepository()
+	remaps := make([]map[uint32]uint32, len(repos))
+	for i, repo := range repos {
+		remap := make(map[uint32]uint32, repo.Count())
+		cursor := repo.Cursor()
+		for cursor.Next() {
+			remap[cursor.ID()] = merged.Intern(cursor.String())
+		}
+		remaps[i] = remap
+	}
+	return merged, remaps
+}
+
+// InternBatchParallel interns strs into a new repository using the
+// specified number of goroutines. The input is split into one contiguous
+// shard per worker, each shard is interned into a temporary repository in
+// parallel, and the temporary repositories are then merged. It returns the
+// merged repository and the ID of each input string within it. If a string
+// can't be interned, e.g. because it's too large, the error for the first
+// shard that failed is returned instead
+func InternBatchParallel(strs []string, workers int) (*Repository, []uint32, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	shardSize := (len(strs) + workers - 1) / workers
+	var shards [][]string
+	for start := 0; start < len(strs); start += shardSize {
+		end := start + shardSize
+		if end > len(strs) {
+			end = len(strs)
+		}
+		shards = append(shards, strs[start:end])
+	}
+
+	repos := make([]*Repository, len(shards))
+	localIDs := make([][]uint32, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard []string) {
+			defer wg.Done()
+			repos[i] = NewRepository()
+			localIDs[i], errs[i] = repos[i].TryInternAll(shard)
+		}(i, shard)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	merged, remaps := MergeMany(repos...)
+	ids := make([]uint32, 0, len(strs))
+	for i, shardIDs := range localIDs {
+		for _, id := range shardIDs {
+			ids = append(ids, remaps[i][id])
+		}
+	}
+	return merged, ids, nil
+}
+
+// HashString returns a stable 64-bit hash of a string, for example to
+// choose a shard before interning. libintern seeds its internal hash
+// randomly for each repository, so this is a separate hash: 64-bit FNV-1a.
+// It will not change between versions of this package
+func HashString(str string) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(str); i++ {
+		hash ^= uint64(str[i])
+		hash *= 1099511628211
+	}
+	return hash
+}
+
+// NewRepositoryWithOptions creates a new string repository with the
+// specified options
+func NewRepositoryWithOptions(opts Options) *Repository {
+	repo := NewRepository()
+	repo.opts = opts
+	if opts.LookupCacheSize > 0 {
+		repo.lookupCache = newLookupCache(opts.LookupCacheSize)
+	}
+	if opts.Instrument {
+		repo.stats = new(callStats)
+	}
+	return repo
+}
+
+// NewRepositoryFromRawPointer wraps a libintern struct strings pointer
+// created by other cgo code, e.g. one returned by RawPointer.
+//
+// OWNERSHIP: if owned is true, the returned repository takes ownership of
+// the pointer and frees it when the repository is garbage collected; the
+// caller must not free it or pass ownership to anything else. If owned is
+// false, the caller remains responsible for freeing the pointer and must
+// keep it alive for as long as the returned repository is used. Getting
+// this wrong results in a double-free or use-after-free.
+//
+// Only the underlying strings are shared. Go-side state such as metadata,
+// options and snapshot validity tracking belongs to each wrapper.
+//
+// Methods that rebuild the strings, such as Retain and OptimizeInPlace,
+// don't modify a pointer the repository doesn't own. The repository takes
+// ownership of the rebuilt strings instead, and stops sharing them
+func NewRepositoryFromRawPointer(p unsafe.Pointer, owned bool) *Repository {
+	repo := &Repository{ptr: (*C.struct_strings)(p), borrowed: !owned}
+	repo.count = repo.Count()
+	if owned {
+		runtime.SetFinalizer(repo, (*Repository).free)
+	}
+	return repo
+}
+
 func newRepositoryFromPtr(ptr *C.struct_strings) *Repository {
 	if ptr == nil {
 		outOfMemory()
 	}
 	hashSeed := rand.Uint32()
 	C.strings_hash_seed(ptr, C.uint32_t(hashSeed))
-	repo := &Repository{ptr}
+	repo := &Repository{ptr: ptr}
+	repo.count = repo.Count()
 	runtime.SetFinalizer(repo, (*Repository).free)
 	return repo
 }
 
 func outOfMemory() {
-	panic("out of memory")
+	panic(ErrOutOfMemory)
+}
+
+// allocFailN is a test hook for exercising out of memory handling. When
+// positive, it's decremented before each allocation, and the allocation
+// that brings it to zero fails. It's only ever set by tests
+var allocFailN int
+
+// maxID is the largest ID that can be assigned. It's only lowered by tests
+var maxID uint32 = math.MaxUint32
+
+func allocFails() bool {
+	if allocFailN <= 0 {
+		return false
+	}
+	allocFailN--
+	return allocFailN == 0
 }
 
 func (repo *Repository) free() {
 	C.strings_free(repo.ptr)
 }
 
+// DisableFinalizer stops the repository's strings from being freed when the
+// repository is garbage collected, so that its lifetime is managed
+// explicitly with Close instead, e.g. by a pool that closes repositories
+// it discards.
+//
+// Repositories with the finalizer disabled must be closed, otherwise their
+// strings are leaked. In particular, sync.Pool drops pooled values without
+// notice, so pooling such repositories there leaks them. The finalizer
+// doesn't need to be disabled for sync.Pool: a pooled repository is
+// reachable, so it's never freed while in the pool
+func (repo *Repository) DisableFinalizer() {
+	runtime.SetFinalizer(repo, nil)
+}
+
+// Close frees the repository's strings. The repository must not be used
+// afterwards. It's only required after DisableFinalizer, but can be called
+// on any repository to free its strings early. Calling Close more than once
+// has no effect, and Close doesn't free a pointer that the repository
+// doesn't own (see NewRepositoryFromRawPointer)
+func (repo *Repository) Close() {
+	runtime.SetFinalizer(repo, nil)
+	if repo.ptr != nil && !repo.borrowed {
+		repo.free()
+	}
+	repo.ptr = nil
+}
+
+// RawPointer returns the underlying libintern struct strings pointer, for
+// use by other cgo code.
+//
+// OWNERSHIP: the repository still owns the pointer and frees it when the
+// repository is garbage collected. The caller must keep the repository
+// alive (e.g. with runtime.KeepAlive) while using the pointer, and must
+// not free it. See NewRepositoryFromRawPointer
+func (repo *Repository) RawPointer() unsafe.Pointer {
+	return unsafe.Pointer(repo.ptr)
+}
+
 // Count returns the total number of unique strings in the repository
 func (repo *Repository) Count() uint32 {
 	return uint32(C.strings_count(repo.ptr))
 }
 
+// Len returns the total number of unique strings in the repository as an
+// int, for comparison with the lengths of slices and maps
+func (repo *Repository) Len() int {
+	return int(repo.Count())
+}
+
+// IsEmpty returns true if the repository contains no strings
+func (repo *Repository) IsEmpty() bool {
+	return repo.Count() == 0
+}
+
 // Intern interns a string and returns its unique ID. Note that IDs increment
 // from 1. This function will panic if the string does not fit in one page -
 // len(string) < repo.PageSize() - or if the uint32 IDs overflow. It is the
 // caller's responsibility to check that these constraints are met
 func (repo *Repository) Intern(str string) uint32 {
-	id := uint32(C.strings_intern(repo.ptr, C.CString(str)))
+	id, err := repo.TryIntern(str)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// TryIntern interns a string and returns its unique ID. It returns
+// ErrStringTooLarge if the string does not fit in one page,
+// ErrIDSpaceExhausted if the string is new but all IDs are in use, or
+// ErrOutOfMemory if the string could not be interned for another reason
+func (repo *Repository) TryIntern(str string) (uint32, error) {
+	str, err := repo.normalize(str)
+	if err != nil {
+		return 0, err
+	}
+	return repo.intern(str)
+}
+
+// internNormalized is like Intern, but also returns the string as stored,
+// i.e. after normalization
+func (repo *Repository) internNormalized(str string) (uint32, string) {
+	str, err := repo.normalize(str)
+	if err != nil {
+		panic(err)
+	}
+	id, err := repo.intern(str)
+	if err != nil {
+		panic(err)
+	}
+	return id, str
+}
+
+// normalize applies the repository's Normalize and SanitizeControl options
+func (repo *Repository) normalize(str string) (string, error) {
+	if repo.opts.Normalize != nil {
+		str = repo.opts.Normalize(str)
+	}
+	if repo.opts.SanitizeControl == Allow || !hasControl(str) {
+		return str, nil
+	}
+	if repo.opts.SanitizeControl == Reject {
+		return "", ErrControlCharacter
+	}
+	stripped := make([]byte, 0, len(str))
+	for i := 0; i < len(str); {
+		r, size := utf8.DecodeRuneInString(str[i:])
+		if !unicode.IsControl(r) {
+			stripped = append(stripped, str[i:i+size]...)
+		}
+		i += size
+	}
+	return string(stripped), nil
+}
+
+func hasControl(str string) bool {
+	for _, r := range str {
+		if unicode.IsControl(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// intern interns a string that has already been normalized
+func (repo *Repository) intern(str string) (uint32, error) {
+	if repo.frozen {
+		return 0, ErrFrozen
+	}
+	if uint64(len(str)) >= pageSize {
+		return 0, stringTooLarge(len(str))
+	}
+	var allocated uint64
+	if repo.byteLimit != 0 {
+		allocated = repo.AllocatedBytes()
+	}
+	if repo.byteLimit != 0 && !repo.fits(len(str), allocated) {
+		repo.stats.add(callLookup)
+		if id := uint32(C.strings_lookup(repo.ptr, C.CString(str))); id != 0 {
+			return id, nil
+		}
+		return 0, ErrCapacityExceeded
+	}
+	if repo.count >= maxID {
+		repo.stats.add(callLookup)
+		if id := uint32(C.strings_lookup(repo.ptr, C.CString(str))); id != 0 {
+			return id, nil
+		}
+		return 0, ErrIDSpaceExhausted
+	}
+	var id uint32
+	if !allocFails() {
+		repo.stats.add(callIntern)
+		id = uint32(C.strings_intern(repo.ptr, C.CString(str)))
+	}
 	if id == 0 {
-		outOfMemory()
+		return 0, ErrOutOfMemory
+	}
+	if id > repo.count {
+		repo.count = id
+		repo.mods++
+		if repo.log != nil {
+			repo.writeLog(id, str)
+		}
+		if repo.byteLimit != 0 {
+			repo.trackPage(len(str), allocated)
+		}
+	}
+	if repo.debug {
+		if stored, _ := repo.LookupID(id); stored != str {
+			panic(fmt.Sprintf("intern: string with ID %d is %q, expected %q", id, stored, str))
+		}
+	}
+	if repo.onGrowth != nil {
+		repo.checkGrowth()
+	}
+	return id, nil
+}
+
+// Freeze makes the repository read-only. Afterwards, TryIntern and Restore
+// return ErrFrozen and Intern panics with it, while lookups continue to
+// work
+func (repo *Repository) Freeze() {
+	repo.frozen = true
+}
+
+// SetByteLimit sets a soft limit on the bytes the repository allocates.
+// Afterwards, TryIntern returns ErrCapacityExceeded and Intern panics with
+// it when interning a new string could take AllocatedBytes past max, while
+// strings that are already in the repository can still be interned and
+// looked up. libintern allocates strings a page at a time, so a string that
+// doesn't fit in the current page is assumed to grow the repository by a
+// whole page. Which page is current is only known once a new page has been
+// seen to be allocated, so until then every new string needs room for a
+// page. Growth of libintern's other data structures is estimated at
+// estimatedEntryOverhead bytes per string, so a resize of those can still
+// take the repository slightly past max. A limit below the current size
+// blocks further growth. A limit of 0 removes the limit
+func (repo *Repository) SetByteLimit(max uint64) {
+	repo.byteLimit = max
+	repo.pageUsed = pageSize
+}
+
+// limitStringPadding is the number of bytes SetByteLimit allows for each
+// string in a page on top of its contents and NUL terminator, e.g. for
+// alignment
+const limitStringPadding = 8
+
+// fits returns whether interning a new string of the specified length
+// keeps the repository, currently allocated bytes in size, within its limit
+func (repo *Repository) fits(length int, allocated uint64) bool {
+	growth := uint64(estimatedEntryOverhead)
+	if repo.pageUsed+uint64(length)+1+limitStringPadding > pageSize {
+		growth += pageSize
+	}
+	return allocated+growth <= repo.byteLimit
+}
+
+// trackPage updates pageUsed after a new string of the specified length was
+// interned into a repository that was allocated bytes in size beforehand
+func (repo *Repository) trackPage(length int, allocated uint64) {
+	size := uint64(length) + 1 + limitStringPadding
+	if repo.AllocatedBytes() >= allocated+pageSize {
+		repo.pageUsed = size
+	} else {
+		repo.pageUsed += size
+	}
+}
+
+// SetDebug enables or disables debug mode. In debug mode, each interned
+// string is checked against the string stored for its ID, and a mismatch
+// (e.g. a string truncated at a NUL byte) causes a panic. Debug mode is
+// off by default since the check has a cost
+func (repo *Repository) SetDebug(debug bool) {
+	repo.debug = debug
+}
+
+// OnGrowthThreshold registers a function to be called once, after an
+// intern, when AllocatedBytes() first exceeds the specified number of
+// bytes. It replaces any previously registered function
+func (repo *Repository) OnGrowthThreshold(bytes uint64, fn func(current uint64)) {
+	repo.growthThreshold = bytes
+	repo.onGrowth = fn
+}
+
+func (repo *Repository) checkGrowth() {
+	if current := repo.AllocatedBytes(); current > repo.growthThreshold {
+		fn := repo.onGrowth
+		repo.onGrowth = nil
+		fn(current)
+	}
+}
+
+// GetOrIntern interns a string and returns its unique ID, calling onMiss
+// if the string was not already in the repository
+func (repo *Repository) GetOrIntern(str string, onMiss func()) uint32 {
+	count := repo.count
+	id := repo.Intern(str)
+	if id > count && onMiss != nil {
+		onMiss()
 	}
 	return id
 }
 
+// InternInto interns a string, appends its ID to dst and returns the ID
+func (repo *Repository) InternInto(str string, dst *[]uint32) uint32 {
+	id := repo.Intern(str)
+	*dst = append(*dst, id)
+	return id
+}
+
+// InternAll interns each string in strs and returns their IDs. It panics
+// under the same conditions as Intern; use TryInternAll to handle errors
+func (repo *Repository) InternAll(strs []string) []uint32 {
+	ids, err := repo.TryInternAll(strs)
+	if err != nil {
+		panic(err)
+	}
+	return ids
+}
+
+// TryInternAll interns each string in strs and returns their IDs. If a
+// string can't be interned, it stops and returns the IDs of the strings
+// interned so far along with the error. Strings that were already interned
+// are left intact. If the ID space is exhausted, the error wraps
+// ErrIDSpaceExhausted and its Index field is the index it stopped at
+func (repo *Repository) TryInternAll(strs []string) ([]uint32, error) {
+	ids := make([]uint32, 0, len(strs))
+	var cache map[string]uint32
+	if repo.opts.BatchCacheSize > 0 {
+		cache = make(map[string]uint32)
+	}
+	for i, str := range strs {
+		if id, ok := cache[str]; ok {
+			ids = append(ids, id)
+			continue
+		}
+		id, err := repo.TryIntern(str)
+		if errors.Is(err, ErrIDSpaceExhausted) {
+			return ids, idSpaceExhausted(i)
+		} else if err != nil {
+			return ids, err
+		}
+		if cache != nil {
+			if len(cache) >= repo.opts.BatchCacheSize {
+				cache = make(map[string]uint32)
+			}
+			cache[str] = id
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// InternAllStrict interns each string in strs and returns their IDs, like
+// InternAll, but requires every string to be new. If a string is already
+// in the repository or repeated in strs, it returns an error wrapping
+// ErrDuplicateString with the offending index and string. If any string
+// can't be interned, the repository is restored to its state before the
+// call and the error is returned
+func (repo *Repository) InternAllStrict(strs []string) ([]uint32, error) {
+	snapshot := repo.Snapshot()
+	ids := make([]uint32, len(strs))
+	for i, str := range strs {
+		count := repo.count
+		id, err := repo.TryIntern(str)
+		if err == nil && id <= count {
+			err = duplicateString(i, str)
+		}
+		if err != nil {
+			repo.Restore(snapshot)
+			return nil, err
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// InternAllNew interns each string in strs, like InternAll, and reports
+// which strings created a new entry. created[i] is true only for the first
+// occurrence of a string that wasn't already in the repository
+func (repo *Repository) InternAllNew(strs []string) (ids []uint32, created []bool) {
+	ids = make([]uint32, len(strs))
+	created = make([]bool, len(strs))
+	for i, str := range strs {
+		count := repo.count
+		ids[i] = repo.Intern(str)
+		created[i] = ids[i] > count
+	}
+	return ids, created
+}
+
+// InternAllCollect interns each string in strs, like TryInternAll, but
+// doesn't stop at the first error. For each string that can't be interned,
+// ids[i] is 0 and errs[i] is the error; otherwise errs[i] is nil
+func (repo *Repository) InternAllCollect(strs []string) (ids []uint32, errs []error) {
+	ids = make([]uint32, len(strs))
+	errs = make([]error, len(strs))
+	for i, str := range strs {
+		id, err := repo.TryIntern(str)
+		if errors.Is(err, ErrIDSpaceExhausted) {
+			err = idSpaceExhausted(i)
+		}
+		ids[i], errs[i] = id, err
+	}
+	return ids, errs
+}
+
+// StreamBatch is a batch of IDs sent by InternStream
+type StreamBatch struct {
+	// IDs are the IDs of the strings in the batch, in order. If Err is set,
+	// they're the IDs of the strings interned before the error
+	IDs []uint32
+	// Err is the error that stopped the stream, if any
+	Err error
+}
+
+// InternStream interns strings received from in, in batches of up to
+// batch strings, and sends the IDs of each batch to the returned channel.
+// A partial batch is interned and sent when in is closed, after which the
+// returned channel is closed. The returned channel is unbuffered, so a slow
+// consumer applies backpressure to the producer. If a string can't be
+// interned, the batch is sent with the error and the stream stops. If ctx
+// is cancelled, the stream stops without sending anything further, so a
+// consumer that stops reading should cancel ctx to release the goroutine.
+// Either way, in isn't read any further and the returned channel is
+// closed. The repository is used from another goroutine, so it must not be
+// used elsewhere until the returned channel is closed
+func (repo *Repository) InternStream(ctx context.Context, in <-chan string, batch int) <-chan StreamBatch {
+	if batch < 1 {
+		batch = 1
+	}
+	out := make(chan StreamBatch)
+	go func() {
+		defer close(out)
+		strs := make([]string, 0, batch)
+		send := func() bool {
+			ids, err := repo.TryInternAll(strs)
+			strs = strs[:0]
+			select {
+			case out <- StreamBatch{ids, err}:
+				return err == nil
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for {
+			select {
+			case str, ok := <-in:
+				if !ok {
+					if len(strs) > 0 {
+						send()
+					}
+					return
+				}
+				strs = append(strs, str)
+				if len(strs) == batch && !send() {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// InternAllUnordered interns each string in strs and returns a map from
+// each distinct string to its ID. Unlike InternAll, it doesn't build an
+// ordered slice of IDs, and it interns each distinct string only once, in
+// sorted order rather than input order, so that strings sharing a prefix
+// are interned together. The order in which new strings are assigned IDs
+// is unspecified
+func (repo *Repository) InternAllUnordered(strs []string) map[string]uint32 {
+	ids := make(map[string]uint32)
+	distinct := make([]string, 0, len(strs))
+	for _, str := range strs {
+		if _, ok := ids[str]; !ok {
+			ids[str] = 0
+			distinct = append(distinct, str)
+		}
+	}
+	sort.Strings(distinct)
+	for _, str := range distinct {
+		ids[str] = repo.Intern(str)
+	}
+	return ids
+}
+
+// InternWithPageInfo is like Intern, but also reports whether interning
+// the string allocated a new page, i.e. whether the previous page filled
+// up. libintern allocates a page at a time, so this is detected by
+// AllocatedBytes growing by at least the page size. Growth of libintern's
+// other data structures by that much is reported the same way
+func (repo *Repository) InternWithPageInfo(str string) (id uint32, newPage bool) {
+	before := repo.AllocatedBytes()
+	id = repo.Intern(str)
+	return id, repo.AllocatedBytes() >= before+pageSize
+}
+
+// InternStringer interns the result of s.String() and returns its ID
+func (repo *Repository) InternStringer(s fmt.Stringer) uint32 {
+	return repo.Intern(s.String())
+}
+
+// InternBytes is like Intern but takes a byte slice, which is interned
+// without first being converted to a Go string
+func (repo *Repository) InternBytes(b []byte) uint32 {
+	if repo.opts.Normalize != nil {
+		// Normalize may retain the string, so it can't alias b
+		return repo.Intern(string(b))
+	}
+	return repo.Intern(bytesToString(b))
+}
+
+// InternBytesAll interns each byte slice in bs and returns their IDs. Like
+// InternBytes, the byte slices aren't converted to Go strings
+func (repo *Repository) InternBytesAll(bs [][]byte) []uint32 {
+	ids := make([]uint32, len(bs))
+	for i, b := range bs {
+		ids[i] = repo.InternBytes(b)
+	}
+	return ids
+}
+
+// InternRunes is like Intern but takes a rune slice, which is encoded as
+// UTF-8 into a buffer that's reused across calls rather than converted to
+// a Go string. It returns the same ID as Intern(string(rs))
+func (repo *Repository) InternRunes(rs []rune) uint32 {
+	buf := repo.runeBuf[:0]
+	var enc [utf8.UTFMax]byte
+	for _, r := range rs {
+		n := utf8.EncodeRune(enc[:], r)
+		buf = append(buf, enc[:n]...)
+	}
+	repo.runeBuf = buf
+	return repo.InternBytes(buf)
+}
+
+// bytesToString returns a string that aliases b without copying it. The
+// string must not be retained, since b may be modified
+func bytesToString(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
+
+// InternNonEmpty is like TryIntern but returns ErrEmptyString rather than
+// interning an empty string. Use Intern or TryIntern to allow empty strings
+func (repo *Repository) InternNonEmpty(str string) (uint32, error) {
+	str, err := repo.normalize(str)
+	if err != nil {
+		return 0, err
+	}
+	if len(str) == 0 {
+		return 0, ErrEmptyString
+	}
+	return repo.intern(str)
+}
+
+// InternSlice interns each string in strs and returns the ID for each
+// position, along with a map of the distinct IDs to their strings as
+// stored, i.e. after normalization. This is useful for dictionary encoding
+// a column while reporting its cardinality
+func (repo *Repository) InternSlice(strs []string) (ids []uint32, unique map[uint32]string) {
+	ids = make([]uint32, len(strs))
+	unique = make(map[uint32]string)
+	for i, str := range strs {
+		id, stored := repo.internNormalized(str)
+		ids[i] = id
+		unique[id] = stored
+	}
+	return ids, unique
+}
+
+// progressChunkSize is the number of strings InternAllProgress interns
+// between progress reports and cancellation checks
+var progressChunkSize = 4096
+
+// InternAllProgress interns each string in strs in chunks, calling progress
+// with the number of strings interned so far after each chunk. If ctx is
+// cancelled, it stops between chunks and returns the IDs of the strings
+// interned so far along with the context's error. It stops in the same way
+// if a string can't be interned, returning the error as TryInternAll does
+func (repo *Repository) InternAllProgress(ctx context.Context, strs []string, progress func(done int)) ([]uint32, error) {
+	ids := make([]uint32, 0, len(strs))
+	for len(ids) < len(strs) {
+		if err := ctx.Err(); err != nil {
+			return ids, err
+		}
+		end := len(ids) + progressChunkSize
+		if end > len(strs) {
+			end = len(strs)
+		}
+		for _, str := range strs[len(ids):end] {
+			id, err := repo.TryIntern(str)
+			if errors.Is(err, ErrIDSpaceExhausted) {
+				return ids, idSpaceExhausted(len(ids))
+			} else if err != nil {
+				return ids, err
+			}
+			ids = append(ids, id)
+		}
+		if progress != nil {
+			progress(len(ids))
+		}
+	}
+	return ids, nil
+}
+
+// InternAllDedup interns each string in strs and returns the strings that
+// were not already in the repository, as stored after normalization and in
+// the order they were first seen, along with their IDs
+func (repo *Repository) InternAllDedup(strs []string) (uniqueStrs []string, uniqueIDs []uint32) {
+	for _, str := range strs {
+		count := repo.count
+		if id, stored := repo.internNormalized(str); id > count {
+			uniqueStrs = append(uniqueStrs, stored)
+			uniqueIDs = append(uniqueIDs, id)
+		}
+	}
+	return uniqueStrs, uniqueIDs
+}
+
+// Append appends the strings in other that the repository doesn't yet
+// have. The repository must be a prefix of other, i.e. each of its strings
+// must have the same ID in other, otherwise ErrDiverged is returned. IDs
+// are preserved in both repositories
+func (repo *Repository) Append(other *Repository) error {
+	count := repo.Count()
+	if other.Count() < count {
+		return ErrDiverged
+	}
+	for id := uint32(1); id <= count; id++ {
+		str, _ := repo.LookupID(id)
+		if otherStr, _ := other.LookupID(id); str != otherStr {
+			return ErrDiverged
+		}
+	}
+	snapshot := repo.Snapshot()
+	for id := count + 1; id <= other.Count(); id++ {
+		str, _ := other.LookupID(id)
+		if _, err := repo.intern(str); err != nil {
+			repo.Restore(snapshot)
+			return err
+		}
+	}
+	return nil
+}
+
 // Lookup returns the ID associated with a string, or false if the ID
 // does not exist in the repository
 func (repo *Repository) Lookup(str string) (uint32, bool) {
+	str, err := repo.normalize(str)
+	if err != nil {
+		return 0, false
+	}
+	repo.stats.add(callLookup)
 	id := uint32(C.strings_lookup(repo.ptr, C.CString(str)))
 	return id, id != 0
 }
 
+// HasAll returns whether each string exists in the repository. It reuses
+// one buffer for all strings, so it allocates less than calling Contains
+// for each string
+func (repo *Repository) HasAll(strs []string) []bool {
+	has := make([]bool, len(strs))
+	var buf []byte
+	for i, str := range strs {
+		str, err := repo.normalize(str)
+		if err != nil {
+			continue
+		}
+		buf = append(append(buf[:0], str...), 0)
+		repo.stats.add(callLookup)
+		id := C.strings_lookup(repo.ptr, (*C.char)(unsafe.Pointer(&buf[0])))
+		has[i] = id != 0
+	}
+	return has
+}
+
+// Sample returns up to n distinct IDs chosen uniformly at random. The same
+// seed always produces the same sample from the same repository
+func (repo *Repository) Sample(n int, seed int64) []uint32 {
+	count := int64(repo.Count())
+	if int64(n) > count {
+		n = int(count)
+	}
+	if n <= 0 {
+		return []uint32{}
+	}
+	// Floyd's algorithm, which samples without replacement using O(n) memory
+	rng := rand.New(rand.NewSource(seed))
+	sample := make([]uint32, 0, n)
+	chosen := make(map[uint32]bool, n)
+	for j := count - int64(n) + 1; j <= count; j++ {
+		id := uint32(rng.Int63n(j) + 1)
+		if chosen[id] {
+			id = uint32(j)
+		}
+		chosen[id] = true
+		sample = append(sample, id)
+	}
+	return sample
+}
+
+// LenByID returns the length of the string associated with an ID without
+// copying the string, or false if the ID does not exist
+func (repo *Repository) LenByID(id uint32) (int, bool) {
+	repo.stats.add(callLookupID)
+	str := C.strings_lookup_id(repo.ptr, C.uint32_t(id))
+	if str == nil {
+		return 0, false
+	}
+	return int(C.strlen(str)), true
+}
+
+// LengthHistogram returns the number of strings of each length
+func (repo *Repository) LengthHistogram() map[int]uint32 {
+	histogram := make(map[int]uint32)
+	cursor := repo.IDCursor()
+	for cursor.Next() {
+		length, _ := repo.LenByID(cursor.ID())
+		histogram[length]++
+	}
+	return histogram
+}
+
+// Contains returns true if the string exists in the repository
+func (repo *Repository) Contains(str string) bool {
+	_, ok := repo.Lookup(str)
+	return ok
+}
+
 // LookupID returns the string associated with an ID, or false if the string
 // does not exist in the repository
 func (repo *Repository) LookupID(id uint32) (string, bool) {
+	if repo.lookupCache != nil {
+		return repo.lookupIDCached(id)
+	}
+	repo.stats.add(callLookupID)
 	str := C.strings_lookup_id(repo.ptr, C.uint32_t(id))
 	if str == nil {
 		return "", false
@@ -122,96 +1098,1108 @@ func (repo *Repository) LookupID(id uint32) (string, bool) {
 	return C.GoString(str), true
 }
 
+func (repo *Repository) lookupIDCached(id uint32) (string, bool) {
+	if str, ok := repo.lookupCache.get(id); ok {
+		return str, true
+	}
+	repo.stats.add(callLookupID)
+	cstr := C.strings_lookup_id(repo.ptr, C.uint32_t(id))
+	if cstr == nil {
+		return "", false
+	}
+	str := C.GoString(cstr)
+	repo.lookupCache.add(id, str)
+	return str, true
+}
+
+// LookupIDBytesInto appends the bytes of the string associated with an ID
+// to dst, which is grown if it has insufficient capacity, and returns the
+// extended slice. No intermediate Go string is allocated. If the string
+// does not exist in the repository, dst is returned unchanged along with
+// false
+func (repo *Repository) LookupIDBytesInto(id uint32, dst []byte) ([]byte, bool) {
+	repo.stats.add(callLookupID)
+	str := C.strings_lookup_id(repo.ptr, C.uint32_t(id))
+	if str == nil {
+		return dst, false
+	}
+	length := int(C.strlen(str))
+	return append(dst, unsafe.Slice((*byte)(unsafe.Pointer(str)), length)...), true
+}
+
+// LookupIDOrDefault returns the string associated with an ID, or def if
+// the ID does not exist in the repository
+func (repo *Repository) LookupIDOrDefault(id uint32, def string) string {
+	if str, ok := repo.LookupID(id); ok {
+		return str
+	}
+	return def
+}
+
+// LookupIDsInto looks up the string associated with each ID and stores them
+// in dst, which is grown if it has insufficient capacity. It returns the
+// resulting slice, which can be passed back in to avoid allocating a new
+// slice for each batch. ErrUnknownID is returned if an ID does not exist
+func (repo *Repository) LookupIDsInto(ids []uint32, dst []string) ([]string, error) {
+	if cap(dst) < len(ids) {
+		dst = make([]string, len(ids))
+	}
+	dst = dst[:len(ids)]
+	for i, id := range ids {
+		str, ok := repo.LookupID(id)
+		if !ok {
+			return dst, ErrUnknownID
+		}
+		dst[i] = str
+	}
+	return dst, nil
+}
+
+// EncodeColumn dictionary encodes a column of values, interning each value
+// and returning the column of IDs. Use DecodeColumn to reverse it
+func (repo *Repository) EncodeColumn(values []string) []uint32 {
+	return repo.InternAll(values)
+}
+
+// DecodeColumn decodes a column of IDs produced by EncodeColumn back into
+// the column of values. ErrUnknownID is returned if an ID does not exist
+func (repo *Repository) DecodeColumn(ids []uint32) ([]string, error) {
+	values, err := repo.LookupIDsInto(ids, nil)
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// SetMeta attaches a metadata value to the string with the specified ID,
+// replacing any previous value. It has no effect if the ID does not exist
+func (repo *Repository) SetMeta(id uint32, meta uint64) {
+	if id == 0 || id > repo.Count() {
+		return
+	}
+	if n := int(id) + 1; n > len(repo.meta) {
+		repo.meta = append(repo.meta, make([]metadata, n-len(repo.meta))...)
+	}
+	repo.meta[id] = metadata{meta, true}
+}
+
+// GetMeta returns the metadata value attached to the string with the
+// specified ID, or false if no value has been attached
+func (repo *Repository) GetMeta(id uint32) (uint64, bool) {
+	if int(id) >= len(repo.meta) {
+		return 0, false
+	}
+	meta := repo.meta[id]
+	return meta.value, meta.set
+}
+
+// FirstN returns the first n strings in order of ID. Fewer strings are
+// returned if the repository contains fewer than n
+func (repo *Repository) FirstN(n int) []string {
+	return repo.strings(1, n)
+}
+
+// LastN returns the last n strings in order of ID. Fewer strings are
+// returned if the repository contains fewer than n
+func (repo *Repository) LastN(n int) []string {
+	count := int(repo.Count())
+	if n > count {
+		n = count
+	}
+	return repo.strings(uint32(count-n+1), n)
+}
+
+// MostRecent returns the ID and string of the most recently interned
+// string, i.e. the one with the highest ID, or false if the repository is
+// empty
+func (repo *Repository) MostRecent() (id uint32, str string, ok bool) {
+	id = repo.Count()
+	if id == 0 {
+		return 0, "", false
+	}
+	str, ok = repo.LookupID(id)
+	return id, str, ok
+}
+
+// strings returns up to n strings in order of ID, starting from id
+func (repo *Repository) strings(id uint32, n int) []string {
+	if count := int(repo.Count()) - int(id) + 1; n > count {
+		n = count
+	}
+	if n < 0 {
+		n = 0
+	}
+	strs := make([]string, n)
+	for i := range strs {
+		strs[i], _ = repo.LookupID(id + uint32(i))
+	}
+	return strs
+}
+
 // AllocatedBytes returns the total number of bytes allocated by the string
 // repository
 func (repo *Repository) AllocatedBytes() uint64 {
 	return uint64(C.strings_allocated_bytes(repo.ptr))
 }
 
+// MemoryProfile reports the memory used by the repository. The strings are
+// allocated by libintern outside of the Go heap, so they don't show up in
+// Go heap profiles; MemoryProfile lets them be monitored separately, e.g. by
+// publishing it with expvar.Func. inUse is the number of bytes allocated,
+// as reported by AllocatedBytes, and pages is the number of pages that
+// those bytes span
+func (repo *Repository) MemoryProfile() (inUse uint64, pages int) {
+	inUse = repo.AllocatedBytes()
+	return inUse, int((inUse + pageSize - 1) / pageSize)
+}
+
+// estimatedEntryOverhead is the number of bytes EstimateBytes assumes each
+// string needs on top of its contents and its slot in the ID index, for its
+// hash entry. The hash table is resized before it's half full, so a string
+// accounts for at most a few slots, well under this
+const estimatedEntryOverhead = 32
+
+// indexEntryBytes is the size of a slot in libintern's ID index, which
+// holds a pointer to each string
+const indexEntryBytes = 8
+
+// minIndexCapacity is the number of slots EstimateBytes assumes libintern
+// allocates for the ID index before doubling it as it fills
+const minIndexCapacity = 16
+
+// indexCapacity returns the number of slots EstimateBytes assumes the ID
+// index has when it holds count strings
+func indexCapacity(count uint64) uint64 {
+	if count == 0 {
+		return 0
+	}
+	capacity := uint64(minIndexCapacity)
+	for capacity < count {
+		capacity *= 2
+	}
+	return capacity
+}
+
+// EstimateBytes estimates how many more bytes AllocatedBytes would report
+// after interning strs, without interning them. Strings that are already in
+// the repository or that can't be interned are ignored, and strings that
+// are repeated in strs are counted once. Each new string is
+// assumed to need its contents plus a NUL terminator packed into pages that
+// strings don't span, plus a fixed per-string overhead. The ID index is
+// assumed to double in size whenever it fills, so a batch that crosses a
+// resize is charged for the whole resize. The estimate is intended to be
+// an upper bound, e.g. to check a batch against a memory budget
+func (repo *Repository) EstimateBytes(strs []string) uint64 {
+	seen := make(map[string]bool)
+	var pages pagePacker
+	var entries uint64
+	var buf []byte
+	for _, str := range strs {
+		str, err := repo.normalize(str)
+		if err != nil || uint64(len(str)) >= pageSize || seen[str] {
+			continue
+		}
+		seen[str] = true
+		buf = append(append(buf[:0], str...), 0)
+		repo.stats.add(callLookup)
+		if C.strings_lookup(repo.ptr, (*C.char)(unsafe.Pointer(&buf[0]))) != 0 {
+			continue
+		}
+		pages.add(len(str))
+		entries++
+	}
+	if entries == 0 {
+		return 0
+	}
+	count := uint64(repo.count)
+	index := (indexCapacity(count+entries) - indexCapacity(count)) * indexEntryBytes
+	return uint64(len(pages.used))*pageSize + entries*estimatedEntryOverhead + index
+}
+
+// pagePacker models how strings are packed into pages, as described by
+// PageCount
+type pagePacker struct {
+	// used is the number of bytes used in each page
+	used []uint64
+}
+
+func (packer *pagePacker) add(length int) {
+	size := uint64(length) + 1
+	last := len(packer.used) - 1
+	if last < 0 || packer.used[last]+size > pageSize {
+		packer.used = append(packer.used, 0)
+		last++
+	}
+	packer.used[last] += size
+}
+
+// packPages packs the strings in the repository into pages, in order of ID
+func (repo *Repository) packPages() pagePacker {
+	var pages pagePacker
+	repo.ForEachBytes(func(id uint32, b []byte) bool {
+		pages.add(len(b))
+		return true
+	})
+	return pages
+}
+
+// PageCount estimates the number of pages that the strings in the
+// repository occupy. libintern doesn't expose its page accounting, so this
+// models how strings are packed into pages: each string and its NUL
+// terminator is stored in one page, and a new page is started when a string
+// doesn't fit in the current one
+func (repo *Repository) PageCount() int {
+	pages := repo.packPages()
+	return len(pages.used)
+}
+
+// PageFillStats estimates the fraction of each page that's used by
+// strings, using the same model as PageCount, and returns the minimum,
+// maximum and average. A low minimum or average means that space is being
+// wasted at the end of pages, e.g. because many strings are a large
+// fraction of the page size. It returns zeros if the repository is empty
+func (repo *Repository) PageFillStats() (min, max, avg float64) {
+	pages := repo.packPages()
+	if len(pages.used) == 0 {
+		return 0, 0, 0
+	}
+	min = 1
+	for _, used := range pages.used {
+		fill := float64(used) / float64(pageSize)
+		if fill < min {
+			min = fill
+		}
+		if fill > max {
+			max = fill
+		}
+		avg += fill
+	}
+	return min, max, avg / float64(len(pages.used))
+}
+
+// Equal returns true if both repositories contain the same strings with
+// the same IDs
+func (repo *Repository) Equal(other *Repository) bool {
+	equal, _ := repo.EqualDetailed(other)
+	return equal
+}
+
+// EqualDetailed is like Equal, but if the repositories aren't equal it
+// also returns a description of the first difference, e.g. for test
+// failure messages. Strings from the repository are described as "got"
+// and strings from other as "want"
+func (repo *Repository) EqualDetailed(other *Repository) (bool, string) {
+	count := repo.Count()
+	if otherCount := other.Count(); otherCount != count {
+		return false, fmt.Sprintf("count differs: %d vs %d", count, otherCount)
+	}
+	for id := uint32(1); id <= count; id++ {
+		str, _ := repo.LookupID(id)
+		if otherStr, _ := other.LookupID(id); str != otherStr {
+			return false, fmt.Sprintf("id %d: got %q, want %q", id, str, otherStr)
+		}
+	}
+	return true, ""
+}
+
+// SameStrings returns true if both repositories contain the same set of
+// strings, regardless of their IDs
+func (repo *Repository) SameStrings(other *Repository) bool {
+	if other.Count() != repo.Count() {
+		return false
+	}
+	cursor := repo.Cursor()
+	for cursor.Next() {
+		if !other.Contains(cursor.String()) {
+			return false
+		}
+	}
+	return true
+}
+
+// IntersectIDs returns the IDs of the strings that are also present in
+// other, in ascending order
+func (repo *Repository) IntersectIDs(other *Repository) []uint32 {
+	var ids []uint32
+	cursor := repo.Cursor()
+	for cursor.Next() {
+		if other.Contains(cursor.String()) {
+			ids = append(ids, cursor.ID())
+		}
+	}
+	return ids
+}
+
+// DifferenceStrings returns the strings that are not present in other, in
+// order of ID
+func (repo *Repository) DifferenceStrings(other *Repository) []string {
+	var strs []string
+	cursor := repo.Cursor()
+	for cursor.Next() {
+		if str := cursor.String(); !other.Contains(str) {
+			strs = append(strs, str)
+		}
+	}
+	return strs
+}
+
+// Diff compares the repository to another, typically an earlier version of
+// it. It returns the strings added (present in the repository but not in
+// other) and removed (present in other but not in the repository), in
+// order of ID
+func (repo *Repository) Diff(other *Repository) (added, removed []string) {
+	return repo.DifferenceStrings(other), other.DifferenceStrings(repo)
+}
+
+// TranslateIDs maps IDs from another repository to the IDs of the same
+// strings in the repository, e.g. to join two columns encoded with
+// different repositories. If an ID does not exist in from, or its string
+// does not exist in the repository, the translated ID is 0 and found[i]
+// is false
+func (repo *Repository) TranslateIDs(from *Repository, ids []uint32) (translated []uint32, found []bool) {
+	translated = make([]uint32, len(ids))
+	found = make([]bool, len(ids))
+	for i, id := range ids {
+		if str, ok := from.LookupID(id); ok {
+			translated[i], found[i] = repo.Lookup(str)
+		}
+	}
+	return translated, found
+}
+
+// Clone creates a deep copy of the repository, including its options and
+// metadata. Snapshots of the repository can't be restored in the clone
+func (repo *Repository) Clone() *Repository {
+	clone := NewRepositoryWithOptions(repo.opts)
+	cursor := repo.Cursor()
+	for cursor.Next() {
+		if _, err := clone.intern(cursor.String()); err != nil {
+			panic(err)
+		}
+	}
+	clone.meta = append([]metadata(nil), repo.meta...)
+	return clone
+}
+
+// CloneCOW is intended to create a copy-on-write clone of the repository.
+// libintern doesn't support sharing memory between repositories, so this
+// currently falls back to a deep copy with Clone
+func (repo *Repository) CloneCOW() *Repository {
+	return repo.Clone()
+}
+
+// Retain rebuilds the repository in place so that it contains only the
+// strings with the specified IDs, in their original order, and frees the
+// memory used by the others. It returns a mapping from old IDs to new IDs,
+// indexed by old ID, where 0 means the string was dropped. Metadata is
+// carried over. All snapshots, and pointers previously returned by
+// RawPointer, are invalidated. Unknown IDs are ignored
+func (repo *Repository) Retain(ids []uint32) []uint32 {
+	if repo.frozen {
+		panic(ErrFrozen)
+	}
+	count := repo.Count()
+	remap := make([]uint32, count+1)
+	for _, id := range ids {
+		if id > 0 && id <= count {
+			remap[id] = 1
+		}
+	}
+	fresh := NewRepository()
+	for id := uint32(1); id <= count; id++ {
+		if remap[id] == 0 {
+			continue
+		}
+		str, _ := repo.LookupID(id)
+		newID, err := fresh.intern(str)
+		if err != nil {
+			panic(err)
+		}
+		remap[id] = newID
+	}
+	meta := repo.remapMeta(remap)
+	repo.replace(fresh)
+	repo.meta = meta
+	return remap
+}
+
+// remapMeta returns the repository's metadata indexed by new ID, given a
+// mapping from old IDs to new IDs where 0 means the string was dropped
+func (repo *Repository) remapMeta(remap []uint32) []metadata {
+	var meta []metadata
+	for id, newID := range remap {
+		if newID == 0 || id >= len(repo.meta) || !repo.meta[id].set {
+			continue
+		}
+		for len(meta) <= int(newID) {
+			meta = append(meta, metadata{})
+		}
+		meta[newID] = repo.meta[id]
+	}
+	return meta
+}
+
+// OptimizeInPlace is like OptimizeWithMapping, but replaces the
+// repository's strings with the optimized strings rather than returning a
+// new repository, and returns the mapping from old IDs to new IDs. The old
+// strings are freed before it returns, rather than when the repository
+// would have been garbage collected, so they don't linger alongside the
+// optimized strings. libintern still builds the optimized strings before
+// the old ones can be freed, so peak memory use is the same as Optimize.
+// Metadata is carried over. All snapshots, and pointers previously
+// returned by RawPointer, are invalidated
+func (repo *Repository) OptimizeInPlace(freq *Frequency) []uint32 {
+	if repo.frozen {
+		panic(ErrFrozen)
+	}
+	optimized, remap := repo.OptimizeWithMapping(freq)
+	meta := repo.remapMeta(remap)
+	repo.replace(optimized)
+	repo.meta = meta
+	return remap
+}
+
+// TrimToCount removes the strings with IDs greater than n, leaving the
+// strings with IDs 1 to n, without needing a snapshot taken at that point.
+// It returns ErrInvalidCount if the repository has fewer than n strings.
+// libintern can only restore to a snapshot, so the repository is rebuilt
+// as with Retain, which invalidates all snapshots. Use Restore instead if a
+// snapshot is available
+func (repo *Repository) TrimToCount(n uint32) error {
+	if repo.frozen {
+		return ErrFrozen
+	}
+	count := repo.Count()
+	if n > count {
+		return ErrInvalidCount
+	} else if n == count {
+		return nil
+	}
+	ids := make([]uint32, n)
+	for i := range ids {
+		ids[i] = uint32(i + 1)
+	}
+	repo.Retain(ids)
+	return nil
+}
+
+// replace frees the repository's strings and takes ownership of the
+// strings in fresh, which must not be used afterwards. If the repository
+// doesn't own its strings, they're left intact for their owner, and the
+// repository owns and finalizes the fresh strings from then on
+func (repo *Repository) replace(fresh *Repository) {
+	runtime.SetFinalizer(fresh, nil)
+	if repo.borrowed {
+		repo.borrowed = false
+		runtime.SetFinalizer(repo, (*Repository).free)
+	} else {
+		C.strings_free(repo.ptr)
+	}
+	repo.ptr = fresh.ptr
+	fresh.ptr = nil
+	repo.count = fresh.count
+	repo.pageUsed = pageSize
+	repo.mods++
+	repo.epoch++
+	repo.restores = nil
+	repo.originalIDs = fresh.originalIDs
+	if repo.lookupCache != nil {
+		repo.lookupCache.clear()
+	}
+	if repo.log != nil {
+		repo.logRebuild()
+	}
+}
+
 // Cursor creates a new cursor for iterating strings
 func (repo *Repository) Cursor() *Cursor {
 	cursor := _Ctype_struct_strings_cursor{}
 	C.strings_cursor_init(&cursor, repo.ptr)
-	return &Cursor{repo, &cursor}
+	return &Cursor{repo: repo, ptr: &cursor, mods: repo.mods}
+}
+
+// Action is returned by a Visitor to control a Walk
+type Action int
+
+const (
+	// Continue continues the walk to the next string
+	Continue Action = iota
+	// Stop stops the walk
+	Stop
+)
+
+// Visitor visits strings during a Walk
+type Visitor interface {
+	Visit(id uint32, str string) Action
+}
+
+// Walk calls v.Visit for each string in the repository in order of ID,
+// until the visitor returns Stop
+func (repo *Repository) Walk(v Visitor) {
+	cursor := repo.Cursor()
+	for cursor.Next() {
+		if v.Visit(cursor.ID(), cursor.String()) == Stop {
+			return
+		}
+	}
+}
+
+// ForEachBytes calls fn with each string in the repository in order of ID,
+// until fn returns false. The byte slice passed to fn aliases memory owned
+// by the repository and is only valid during the call: it must not be
+// modified or retained, and must be copied if it's needed afterwards. In
+// exchange, no string is allocated for each call
+func (repo *Repository) ForEachBytes(fn func(id uint32, b []byte) bool) {
+	cursor := repo.Cursor()
+	for cursor.Next() {
+		if !fn(cursor.ID(), cursor.bytes()) {
+			return
+		}
+	}
+}
+
+// IDs returns the IDs of all strings in the repository, in order
+func (repo *Repository) IDs() []uint32 {
+	ids := make([]uint32, repo.Count())
+	for i := range ids {
+		ids[i] = uint32(i + 1)
+	}
+	return ids
+}
+
+// IDCursor creates a new cursor for iterating string IDs without reading
+// the strings
+func (repo *Repository) IDCursor() *IDCursor {
+	cursor := _Ctype_struct_strings_cursor{}
+	C.strings_cursor_init(&cursor, repo.ptr)
+	return &IDCursor{repo, &cursor, repo.mods}
 }
 
 // Optimize creates a new, optimized string repository which stores the most
 // frequently seen strings together. The string with the lowest ID (1) is the
 // most frequently seen string
 func (repo *Repository) Optimize(freq *Frequency) *Repository {
-	ptr := C.strings_optimize(repo.ptr, freq.ptr)
+	var ptr *C.struct_strings
+	if !allocFails() {
+		ptr = C.strings_optimize(repo.ptr, freq.ptr)
+	}
+	// freq's finalizer must not free its counts during the call
+	runtime.KeepAlive(freq)
 	return newRepositoryFromPtr(ptr)
 }
 
+// OptimizeWithMapping is like Optimize, but also returns a mapping from
+// old IDs to new IDs, indexed by old ID. The mapping is kept with the new
+// repository, so that it's available from OriginalIDMapping and written
+// out by WriteTo, e.g. so that data encoded with the old IDs can still be
+// decoded
+func (repo *Repository) OptimizeWithMapping(freq *Frequency) (*Repository, []uint32) {
+	optimized := repo.Optimize(freq)
+	remap := make([]uint32, repo.Count()+1)
+	cursor := repo.Cursor()
+	for cursor.Next() {
+		remap[cursor.ID()], _ = optimized.Lookup(cursor.String())
+	}
+	optimized.originalIDs = remap
+	return optimized, remap
+}
+
+// OriginalIDMapping returns the mapping from old IDs to IDs in this
+// repository, indexed by old ID, if the repository was created by
+// OptimizeWithMapping or read from the output of WriteTo on such a
+// repository. The mapping must not be modified
+func (repo *Repository) OriginalIDMapping() ([]uint32, bool) {
+	return repo.originalIDs, repo.originalIDs != nil
+}
+
+// OptimizeThreshold is like Optimize, but only moves strings seen at least
+// minCount times to the front of the new repository, ordered by frequency
+// with ties in original order. The remaining strings follow in their
+// original order. Unlike Optimize, this includes strings that were never
+// seen, so no strings are dropped. It also returns a mapping from old IDs
+// to new IDs, indexed by old ID
+func (repo *Repository) OptimizeThreshold(freq *Frequency, minCount uint64) (*Repository, []uint32) {
+	var frequent, rest []FrequencyEntry
+	for _, entry := range repo.FrequencyReport(freq) {
+		if entry.Count >= minCount {
+			frequent = append(frequent, entry)
+		} else {
+			rest = append(rest, entry)
+		}
+	}
+	sort.Stable(byCount{frequent, nil})
+	return rebuild(append(frequent, rest...), repo.Count())
+}
+
+// OptimizeWith is like Optimize, but strings seen the same number of times
+// are ordered using less, and then by original ID if less reports neither
+// is less than the other. This gives full control over the layout of the
+// new repository. Unlike Optimize, strings that were never seen are kept,
+// ordered last. It also returns a mapping from old IDs to new IDs, indexed
+// by old ID
+func (repo *Repository) OptimizeWith(freq *Frequency, less func(a, b FrequencyEntry) bool) (*Repository, []uint32) {
+	entries := repo.FrequencyReport(freq)
+	sort.Stable(byCount{entries, less})
+	return rebuild(entries, repo.Count())
+}
+
+// rebuild creates a new repository containing the entries' strings in
+// order, and returns it along with a mapping from the entries' IDs to new
+// IDs, indexed by the entries' IDs, which must not exceed count
+func rebuild(entries []FrequencyEntry, count uint32) (*Repository, []uint32) {
+	rebuilt := NewRepository()
+	remap := make([]uint32, count+1)
+	for _, entry := range entries {
+		remap[entry.ID] = rebuilt.Intern(entry.String)
+	}
+	return rebuilt, remap
+}
+
+// byCount sorts entries by descending count, then using less if set
+type byCount struct {
+	entries []FrequencyEntry
+	less    func(a, b FrequencyEntry) bool
+}
+
+func (s byCount) Len() int      { return len(s.entries) }
+func (s byCount) Swap(i, j int) { s.entries[i], s.entries[j] = s.entries[j], s.entries[i] }
+
+func (s byCount) Less(i, j int) bool {
+	a, b := s.entries[i], s.entries[j]
+	if a.Count != b.Count || s.less == nil {
+		return a.Count > b.Count
+	}
+	return s.less(a, b)
+}
+
+// Compact creates a new repository containing only the strings that have
+// a nonzero frequency, in their original order. It also returns a mapping
+// from old IDs to new IDs, indexed by old ID, where 0 means the string was
+// dropped
+func (repo *Repository) Compact(freq *Frequency) (*Repository, []uint32) {
+	compacted := NewRepository()
+	remap := make([]uint32, repo.Count()+1)
+	cursor := repo.Cursor()
+	for cursor.Next() {
+		if id := cursor.ID(); freq.count(id) > 0 {
+			remap[id] = compacted.Intern(cursor.String())
+		}
+	}
+	return compacted, remap
+}
+
+// Savings describes how much memory interning saves compared to storing
+// every occurrence of a string
+type Savings struct {
+	// TotalOccurrences is the number of string occurrences seen
+	TotalOccurrences uint64
+	// UniqueStrings is the number of unique strings in the repository
+	UniqueStrings uint32
+	// NaiveBytes is the number of string bytes required to store every
+	// occurrence
+	NaiveBytes uint64
+	// InternedBytes is the number of string bytes required to store each
+	// unique string once
+	InternedBytes uint64
+}
+
+// SavingsReport reports the savings made by interning, using freq as the
+// number of occurrences of each string in the repository
+func (repo *Repository) SavingsReport(freq *Frequency) Savings {
+	savings := Savings{UniqueStrings: repo.Count()}
+	cursor := repo.Cursor()
+	for cursor.Next() {
+		length := uint64(len(cursor.String()))
+		count := freq.count(cursor.ID())
+		savings.TotalOccurrences += count
+		savings.NaiveBytes += count * length
+		savings.InternedBytes += length
+	}
+	return savings
+}
+
+// FrequencyEntry is a string in the repository along with the number of
+// occurrences recorded for it
+type FrequencyEntry struct {
+	String string
+	ID     uint32
+	Count  uint64
+}
+
+// FrequencyReport returns each string in the repository, in order of ID,
+// along with the number of occurrences of it recorded in freq
+func (repo *Repository) FrequencyReport(freq *Frequency) []FrequencyEntry {
+	entries := make([]FrequencyEntry, 0, repo.Count())
+	cursor := repo.Cursor()
+	for cursor.Next() {
+		id := cursor.ID()
+		entries = append(entries, FrequencyEntry{cursor.String(), id, freq.count(id)})
+	}
+	return entries
+}
+
 // Snapshot creates a new snapshot of the repository. It can later be
 // restored to this position
 func (repo *Repository) Snapshot() *Snapshot {
 	snapshot := _Ctype_struct_strings_snapshot{}
 	C.strings_snapshot(repo.ptr, &snapshot)
-	return &Snapshot{repo, &snapshot}
+	return &Snapshot{repo, &snapshot, repo.Count(), repo.restoreSeq, repo.epoch}
 }
 
 // Restore restores the string repository to a previous snapshot
 func (repo *Repository) Restore(snapshot *Snapshot) error {
+	if repo.frozen {
+		return ErrFrozen
+	}
+	if !repo.valid(snapshot) {
+		return ErrInvalidSnapshot
+	}
 	if ok := C.strings_restore(repo.ptr, snapshot.ptr); !ok {
 		return ErrInvalidSnapshot
 	}
+	repo.recordRestore(snapshot.count)
+	if repo.log != nil && snapshot.count < repo.count {
+		repo.writeLogTruncate(snapshot.count)
+	}
+	repo.count = snapshot.count
+	repo.pageUsed = pageSize
+	repo.mods++
+	if repo.lookupCache != nil {
+		repo.lookupCache.clear()
+	}
+	if int(snapshot.count) < len(repo.meta)-1 {
+		repo.meta = repo.meta[:snapshot.count+1]
+	}
+	return nil
+}
+
+// CompactTo restores the repository to a snapshot, like Restore, and then
+// rebuilds it as with Retain so that the memory used by the strings that
+// were removed is reclaimed. Restore alone leaves that memory allocated.
+// Since the repository is rebuilt, all snapshots, including the one it was
+// restored to, are invalidated
+func (repo *Repository) CompactTo(snapshot *Snapshot) error {
+	if err := repo.Restore(snapshot); err != nil {
+		return err
+	}
+	repo.Retain(repo.IDs())
 	return nil
 }
 
-// PageSize returns the compile-time page size setting
+// ValidSnapshots reports, for each snapshot, whether it can still be
+// restored. Unlike Restore, it doesn't modify the repository
+func (repo *Repository) ValidSnapshots(snapshots []*Snapshot) []bool {
+	valid := make([]bool, len(snapshots))
+	for i, snapshot := range snapshots {
+		valid[i] = repo.valid(snapshot)
+	}
+	return valid
+}
+
+// recordRestore records a restore to count. Only the restore points that
+// can still invalidate a snapshot are kept: a restore to a lower count
+// supersedes any earlier restore to a higher count, so the counts in
+// repo.restores are strictly increasing
+func (repo *Repository) recordRestore(count uint32) {
+	repo.restoreSeq++
+	n := len(repo.restores)
+	for n > 0 && repo.restores[n-1].count >= count {
+		n--
+	}
+	repo.restores = append(repo.restores[:n], restorePoint{repo.restoreSeq, count})
+}
+
+// valid returns true if the snapshot can be restored, i.e. the strings it
+// covers have not been discarded by a restore since it was taken
+func (repo *Repository) valid(snapshot *Snapshot) bool {
+	if snapshot.repo != repo || snapshot.epoch != repo.epoch || snapshot.count > repo.Count() {
+		return false
+	}
+	for i := len(repo.restores) - 1; i >= 0 && repo.restores[i].seq > snapshot.seq; i-- {
+		if repo.restores[i].count < snapshot.count {
+			return false
+		}
+	}
+	return true
+}
+
+// pageSize caches the page size so that intern can check string lengths
+// without an extra cgo call
+var pageSize = uint64(C.strings_page_size())
+
+// PageSize returns the compile-time page size setting. The repository grows
+// by allocating one page at a time; libintern does not expose a growth
+// strategy, so this is the only tuning knob and it is fixed when libintern
+// is compiled
 func (repo *Repository) PageSize() uint64 {
 	return uint64(C.strings_page_size())
 }
 
 // Snapshot is a snapshot of a string repository
 type Snapshot struct {
-	repo *Repository
-	ptr  *C.struct_strings_snapshot
+	repo  *Repository
+	ptr   *C.struct_strings_snapshot
+	count uint32
+	seq   uint64
+	epoch uint64
+}
+
+// Staging is used to speculatively intern strings, which are either kept
+// with Commit or discarded with Rollback. Stagings can be nested, as long
+// as an inner staging is finished before the outer one
+type Staging struct {
+	repo     *Repository
+	snapshot *Snapshot
+	done     bool
+}
+
+// Begin starts staging strings. Strings interned afterwards are discarded
+// if the staging is rolled back
+func (repo *Repository) Begin() *Staging {
+	return &Staging{repo: repo, snapshot: repo.Snapshot()}
+}
+
+// Commit keeps the strings interned since Begin. It has no effect if the
+// staging has already been committed or rolled back
+func (staging *Staging) Commit() {
+	staging.done = true
+}
+
+// Rollback discards the strings interned since Begin, restoring the
+// repository to the snapshot taken by Begin. It has no effect if the
+// staging has already been committed or rolled back, so it's safe to defer
+// a Rollback and Commit on success. It returns an error under the same
+// conditions as Restore, e.g. if an outer staging was rolled back first
+func (staging *Staging) Rollback() error {
+	if staging.done {
+		return nil
+	}
+	if err := staging.repo.Restore(staging.snapshot); err != nil {
+		return err
+	}
+	staging.done = true
+	return nil
 }
 
 // Cursor is used to iterate strings in a repository
 type Cursor struct {
 	repo *Repository
 	ptr  *C.struct_strings_cursor
+	done bool
+	mods uint64
+
+	// snapshot is set for cursors created by SnapshotCursor, which iterate
+	// strs, the strings captured at creation, instead of using ptr. pos is
+	// the ID the cursor currently points to
+	snapshot bool
+	strs     []*C.char
+	pos      uint32
+}
+
+// SnapshotCursor creates a new cursor that iterates only the strings in
+// the repository when it's created. Pointers to the strings are captured
+// up front, so iterating the cursor doesn't touch the repository, and it
+// can be used from one goroutine while another interns new strings. This
+// relies on interning only ever appending: strings are never moved once
+// interned.
+//
+// The guarantee doesn't extend to operations that remove strings, e.g.
+// Restore, Retain or Close, which free the captured strings; those must
+// not run while the cursor is in use. The repository itself must still
+// only be used from one goroutine at a time; only the cursor is safe to
+// use concurrently with it
+func (repo *Repository) SnapshotCursor() *Cursor {
+	strs := make([]*C.char, 0, repo.Count())
+	cursor := repo.Cursor()
+	for cursor.Next() {
+		strs = append(strs, C.strings_cursor_string(cursor.ptr))
+	}
+	return &Cursor{repo: repo, snapshot: true, strs: strs}
 }
 
 // ID returns the ID that the cursor currently points to
 func (cursor *Cursor) ID() uint32 {
+	if cursor.snapshot {
+		if cursor.pos > uint32(len(cursor.strs)) {
+			return 0
+		}
+		return cursor.pos
+	}
 	return uint32(C.strings_cursor_id(cursor.ptr))
 }
 
 // String returns the string that the cursor currently points to
 func (cursor *Cursor) String() string {
-	str := C.strings_cursor_string(cursor.ptr)
+	str := cursor.cstring()
 	if str == nil {
 		return ""
 	}
 	return C.GoString(str)
 }
 
+// At returns the ID and string that the cursor currently points to. It's
+// equivalent to calling ID and String, but with a single cgo call
+func (cursor *Cursor) At() (uint32, string) {
+	if cursor.snapshot {
+		return cursor.ID(), cursor.String()
+	}
+	var id C.uint32_t
+	str := C.cursor_at(cursor.ptr, &id)
+	if str == nil {
+		return uint32(id), ""
+	}
+	return uint32(id), C.GoString(str)
+}
+
+// bytes returns the bytes of the string that the cursor currently points
+// to, without copying them. The slice aliases C memory and is only valid
+// until the repository is next modified
+func (cursor *Cursor) bytes() []byte {
+	str := cursor.cstring()
+	if str == nil {
+		return nil
+	}
+	length := int(C.strlen(str))
+	return unsafe.Slice((*byte)(unsafe.Pointer(str)), length)
+}
+
+func (cursor *Cursor) cstring() *C.char {
+	if cursor.snapshot {
+		if id := cursor.ID(); id != 0 {
+			return cursor.strs[id-1]
+		}
+		return nil
+	}
+	return C.strings_cursor_string(cursor.ptr)
+}
+
 // Next advances the cursor. It returns true if there is another
-// string, and false otherwise
+// string, and false otherwise. It panics if the repository has been
+// modified since the cursor was created, unless the cursor was created by
+// SnapshotCursor
 func (cursor *Cursor) Next() bool {
+	if cursor.snapshot {
+		return cursor.skipSnapshot(1)
+	}
+	checkModification(cursor.repo, cursor.mods)
+	cursor.repo.stats.add(callCursorNext)
+	if !C.strings_cursor_next(cursor.ptr) {
+		cursor.done = true
+		return false
+	}
+	return true
+}
+
+// SkipN advances the cursor n positions, as if Next was called n times. It
+// returns true if the cursor points to a string afterwards, and false
+// otherwise. The cursor is advanced with a single cgo call, so SkipN is much
+// faster than calling Next in a loop
+func (cursor *Cursor) SkipN(n int) bool {
+	if cursor.snapshot {
+		return cursor.skipSnapshot(n)
+	}
+	checkModification(cursor.repo, cursor.mods)
+	if cursor.done {
+		return false
+	}
+	if n > 0 {
+		cursor.repo.stats.add(callCursorNext)
+		if !C.cursor_skip(cursor.ptr, C.int(n)) {
+			cursor.done = true
+			return false
+		}
+	}
+	return cursor.ID() != 0
+}
+
+func (cursor *Cursor) skipSnapshot(n int) bool {
+	if cursor.done {
+		return false
+	}
+	count := uint32(len(cursor.strs))
+	if n > 0 {
+		if uint64(cursor.pos)+uint64(n) > uint64(count) {
+			cursor.pos = count + 1
+			cursor.done = true
+			return false
+		}
+		cursor.pos += uint32(n)
+	}
+	return cursor.pos != 0
+}
+
+// Remaining returns the number of strings after the one the cursor
+// currently points to
+func (cursor *Cursor) Remaining() uint32 {
+	if cursor.done {
+		return 0
+	}
+	if cursor.snapshot {
+		return uint32(len(cursor.strs)) - cursor.pos
+	}
+	return cursor.repo.Count() - cursor.ID()
+}
+
+// checkModification panics if strings have been added to or removed from
+// the repository since a cursor was created, which would otherwise leave
+// the cursor in an undefined state
+func checkModification(repo *Repository, mods uint64) {
+	if repo.mods != mods {
+		panic("intern: concurrent modification during iteration")
+	}
+}
+
+// IDCursor is used to iterate string IDs in a repository
+type IDCursor struct {
+	repo *Repository
+	ptr  *C.struct_strings_cursor
+	mods uint64
+}
+
+// ID returns the ID that the cursor currently points to
+func (cursor *IDCursor) ID() uint32 {
+	return uint32(C.strings_cursor_id(cursor.ptr))
+}
+
+// Next advances the cursor. It returns true if there is another
+// ID, and false otherwise. It panics if the repository has been modified
+// since the cursor was created
+func (cursor *IDCursor) Next() bool {
+	checkModification(cursor.repo, cursor.mods)
+	cursor.repo.stats.add(callCursorNext)
 	return bool(C.strings_cursor_next(cursor.ptr))
 }
 
 // Frequency is used to track string frequencies
 type Frequency struct {
-	ptr *C.struct_strings_frequency
+	ptr    *C.struct_strings_frequency
+	counts []uint64
 }
 
 // NewFrequency creates a new string frequency tracker
 func NewFrequency() *Frequency {
-	ptr := C.strings_frequency_new()
+	var ptr *C.struct_strings_frequency
+	if !allocFails() {
+		ptr = C.strings_frequency_new()
+	}
 	if ptr == nil {
 		outOfMemory()
 	}
-	freq := &Frequency{ptr}
+	freq := &Frequency{ptr: ptr}
 	runtime.SetFinalizer(freq, (*Frequency).free)
 	return freq
 }
 
+// NewFrequencyWithCapacity creates a new string frequency tracker with room
+// for IDs up to maxID, to avoid reallocating as IDs are added. libintern
+// doesn't allow presizing its own counts, so only the Go-side counts are
+// preallocated
+func NewFrequencyWithCapacity(maxID uint32) *Frequency {
+	freq := NewFrequency()
+	freq.counts = make([]uint64, 0, int(maxID)+1)
+	return freq
+}
+
 func (freq *Frequency) free() {
 	C.strings_frequency_free(freq.ptr)
 }
@@ -219,15 +2207,35 @@ func (freq *Frequency) free() {
 // Add adds a string ID. This should be called after interning a string and
 // getting back the ID
 func (freq *Frequency) Add(id uint32) {
-	if ok := C.strings_frequency_add(freq.ptr, C.uint32_t(id)); !ok {
+	if ok := !allocFails() && bool(C.strings_frequency_add(freq.ptr, C.uint32_t(id))); !ok {
 		outOfMemory()
 	}
+	freq.increment(id)
 }
 
 // AddAll adds all string IDs, to ensure that each string is present in the
 // optimized repository
 func (freq *Frequency) AddAll(repo *Repository) {
-	if ok := C.strings_frequency_add_all(freq.ptr, repo.ptr); !ok {
+	if ok := !allocFails() && bool(C.strings_frequency_add_all(freq.ptr, repo.ptr)); !ok {
 		outOfMemory()
 	}
+	for id := repo.Count(); id > 0; id-- {
+		freq.increment(id)
+	}
+}
+
+// increment mirrors a C-side add so that counts can be read back from Go
+func (freq *Frequency) increment(id uint32) {
+	if n := int(id) + 1; n > len(freq.counts) {
+		freq.counts = append(freq.counts, make([]uint64, n-len(freq.counts))...)
+	}
+	freq.counts[id]++
+}
+
+// count returns the number of times an ID has been added
+func (freq *Frequency) count(id uint32) uint64 {
+	if int(id) >= len(freq.counts) {
+		return 0
+	}
+	return freq.counts[id]
 }
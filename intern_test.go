@@ -1,8 +1,14 @@
 package intern
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"unicode/utf8"
 )
 
 func TestIntern(t *testing.T) {
@@ -36,6 +42,94 @@ func TestAllocatedBytes(t *testing.T) {
 	}
 }
 
+func TestMemoryProfile(t *testing.T) {
+	repo := NewRepository()
+	inUse, pages := repo.MemoryProfile()
+	if inUse != repo.AllocatedBytes() || pages < 1 {
+		t.Error("invalid MemoryProfile() result")
+	}
+	for i := 0; i < 10000; i++ {
+		repo.Intern(fmt.Sprintf("string %d", i))
+	}
+	grown, grownPages := repo.MemoryProfile()
+	if grown != repo.AllocatedBytes() || grown <= inUse || grownPages <= pages {
+		t.Error("expected MemoryProfile() to track AllocatedBytes()")
+	}
+	if uint64(grownPages)*repo.PageSize() < grown {
+		t.Error("expected pages to span the bytes in use")
+	}
+}
+
+func TestPageFillStats(t *testing.T) {
+	repo := NewRepository()
+	if repo.PageCount() != 0 {
+		t.Error("expected no pages")
+	}
+	if min, max, avg := repo.PageFillStats(); min != 0 || max != 0 || avg != 0 {
+		t.Error("expected zero fill stats")
+	}
+
+	// four strings fill a page exactly, including NUL terminators
+	length := int(repo.PageSize()/4) - 1
+	for _, c := range "abcdef" {
+		repo.Intern(strings.Repeat(string(c), length))
+	}
+	if repo.PageCount() != 2 {
+		t.Errorf("invalid PageCount() result: %d", repo.PageCount())
+	}
+	if min, max, avg := repo.PageFillStats(); min != 0.5 || max != 1 || avg != 0.75 {
+		t.Errorf("invalid PageFillStats() result: %v, %v, %v", min, max, avg)
+	}
+
+	// a string that doesn't fit in the second page starts a third
+	repo.Intern(strings.Repeat("g", 3*length))
+	if repo.PageCount() != 3 {
+		t.Errorf("invalid PageCount() result: %d", repo.PageCount())
+	}
+	third := float64(3*length+1) / float64(repo.PageSize())
+	if min, max, avg := repo.PageFillStats(); min != 0.5 || max != 1 || avg != (1.5+third)/3 {
+		t.Errorf("invalid PageFillStats() result: %v, %v, %v", min, max, avg)
+	}
+}
+
+func TestEstimateBytes(t *testing.T) {
+	repo := NewRepository()
+	for i := 0; i < 100; i++ {
+		repo.Intern(fmt.Sprintf("existing %d", i))
+	}
+	var strs []string
+	for i := 0; i < 5000; i++ {
+		strs = append(strs, fmt.Sprintf("string %d", i%2000), fmt.Sprintf("existing %d", i%100))
+	}
+	estimate := repo.EstimateBytes(strs)
+	if repo.EstimateBytes(nil) != 0 || repo.EstimateBytes([]string{"existing 1"}) != 0 {
+		t.Error("expected no estimate for no new strings")
+	}
+
+	before := repo.AllocatedBytes()
+	repo.InternAll(strs)
+	actual := repo.AllocatedBytes() - before
+	if estimate < actual {
+		t.Errorf("estimate %d is less than actual %d", estimate, actual)
+	}
+	if estimate > 3*actual {
+		t.Errorf("estimate %d is much more than actual %d", estimate, actual)
+	}
+}
+
+func TestEstimateBytesResize(t *testing.T) {
+	repo := NewRepository()
+	for i := 0; i < 5000; i++ {
+		str := fmt.Sprintf("string %d", i)
+		estimate := repo.EstimateBytes([]string{str})
+		before := repo.AllocatedBytes()
+		repo.Intern(str)
+		if actual := repo.AllocatedBytes() - before; estimate < actual {
+			t.Fatalf("estimate %d is less than actual %d after %d strings", estimate, actual, i)
+		}
+	}
+}
+
 func TestPageSize(t *testing.T) {
 	repo := NewRepository()
 	if repo.PageSize() == 0 {
@@ -54,6 +148,106 @@ func TestLookupID(t *testing.T) {
 	}
 }
 
+func TestLookupIDBytesInto(t *testing.T) {
+	repo := NewRepository()
+	for _, str := range []string{"foo", "", "héllo"} {
+		repo.Intern(str)
+	}
+	row := make([]byte, 0, 4)
+	for _, id := range []uint32{1, 2, 3, 1} {
+		var ok bool
+		if row, ok = repo.LookupIDBytesInto(id, row); !ok {
+			t.Errorf("expected ID %d to exist", id)
+		}
+		row = append(row, '|')
+	}
+	if string(row) != "foo||héllo|foo|" {
+		t.Errorf("invalid LookupIDBytesInto() result: %q", row)
+	}
+	if dst, ok := repo.LookupIDBytesInto(4, row); ok || string(dst) != string(row) {
+		t.Error("expected dst to be unchanged for an unknown ID")
+	}
+}
+
+func TestLookupIDOrDefault(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	if str := repo.LookupIDOrDefault(1, "?"); str != "foo" {
+		t.Error("invalid LookupIDOrDefault() result for present ID")
+	}
+	if str := repo.LookupIDOrDefault(2, "?"); str != "?" {
+		t.Error("invalid LookupIDOrDefault() result for absent ID")
+	}
+	if str := repo.LookupIDOrDefault(0, ""); str != "" {
+		t.Error("invalid LookupIDOrDefault() result for ID 0")
+	}
+}
+
+func TestLookupCache(t *testing.T) {
+	repo := NewRepositoryWithOptions(Options{LookupCacheSize: 2})
+	for _, str := range []string{"foo", "bar", "qux"} {
+		repo.Intern(str)
+	}
+	for _, id := range []uint32{1, 2, 1, 3, 2, 1, 3} {
+		str, ok := repo.LookupID(id)
+		if expected := []string{"foo", "bar", "qux"}[id-1]; !ok || str != expected {
+			t.Errorf("expected %q for ID %d, got %q", expected, id, str)
+		}
+	}
+	if _, ok := repo.LookupID(4); ok {
+		t.Error("expected unknown ID to be absent")
+	}
+	if len(repo.lookupCache.entries) != 2 || repo.lookupCache.order.Len() != 2 {
+		t.Error("expected the cache to be bounded")
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		repo.LookupID(3)
+	}); allocs >= 1 {
+		t.Errorf("expected cached lookups not to allocate, got %v allocs", allocs)
+	}
+
+	snapshot := repo.Snapshot()
+	repo.Intern("xyz")
+	repo.LookupID(4)
+	repo.Restore(snapshot)
+	repo.Intern("abc")
+	if str, ok := repo.LookupID(4); !ok || str != "abc" {
+		t.Errorf("expected the cache to be invalidated by Restore, got %q", str)
+	}
+	repo.Retain([]uint32{4})
+	if str, ok := repo.LookupID(1); !ok || str != "abc" {
+		t.Errorf("expected the cache to be invalidated by Retain, got %q", str)
+	}
+}
+
+func TestLookupCacheConcurrent(t *testing.T) {
+	repo := NewRepositoryWithOptions(Options{LookupCacheSize: 4})
+	var strs []string
+	for i := 0; i < 16; i++ {
+		strs = append(strs, fmt.Sprintf("string %d", i))
+	}
+	repo.InternAll(strs)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				id := uint32((g+i)%len(strs)) + 1
+				if str, ok := repo.LookupID(id); !ok || str != strs[id-1] {
+					t.Errorf("invalid LookupID() result for %d: %q", id, str)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if len(repo.lookupCache.entries) != 4 || repo.lookupCache.order.Len() != 4 {
+		t.Error("expected the cache to be bounded")
+	}
+}
+
 func TestCount(t *testing.T) {
 	repo := NewRepository()
 	if repo.Count() != 0 {
@@ -73,6 +267,44 @@ func TestCount(t *testing.T) {
 	}
 }
 
+func TestLen(t *testing.T) {
+	repo := NewRepository()
+	strs := []string{"foo", "bar", "foo", "qux"}
+	for i, str := range strs {
+		if repo.Len() != int(repo.Count()) || repo.Len() > i {
+			t.Error("invalid Len() result")
+		}
+		repo.Intern(str)
+	}
+	if repo.Len() != 3 || repo.Len() != int(repo.Count()) {
+		t.Error("invalid Len() result")
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+	repo := NewRepository()
+	if !repo.IsEmpty() {
+		t.Error("expected a new repository to be empty")
+	}
+	repo.Intern("")
+	if repo.IsEmpty() {
+		t.Error("expected a repository with a string to be non-empty")
+	}
+}
+
+func TestMostRecent(t *testing.T) {
+	repo := NewRepository()
+	if id, str, ok := repo.MostRecent(); ok || id != 0 || str != "" {
+		t.Error("expected no MostRecent() result for an empty repository")
+	}
+	repo.Intern("foo")
+	repo.Intern("bar")
+	repo.Intern("foo")
+	if id, str, ok := repo.MostRecent(); !ok || id != 2 || str != "bar" {
+		t.Errorf("invalid MostRecent() result: %d, %q, %v", id, str, ok)
+	}
+}
+
 func TestLargeRepository(t *testing.T) {
 	if testing.Short() {
 		t.SkipNow()
@@ -197,3 +429,1960 @@ func TestOptimize(t *testing.T) {
 	optimized = repo.Optimize(freq)
 	assertStrings(t, optimized, []string{"baz", "bar", "foo"})
 }
+
+func TestSavingsReport(t *testing.T) {
+	repo := NewRepository()
+	freq := NewFrequency()
+	for _, str := range []string{"foo", "foobar", "foo", "x", "foo", "foobar"} {
+		freq.Add(repo.Intern(str))
+	}
+	repo.Intern("unseen")
+
+	savings := repo.SavingsReport(freq)
+	expected := Savings{
+		TotalOccurrences: 6,
+		UniqueStrings:    4,
+		NaiveBytes:       3*3 + 2*6 + 1,
+		InternedBytes:    3 + 6 + 1 + 6,
+	}
+	if savings != expected {
+		t.Errorf("invalid SavingsReport() result: %+v", savings)
+	}
+}
+
+func TestFrequencyReport(t *testing.T) {
+	repo := NewRepository()
+	freq := NewFrequency()
+	for _, str := range []string{"foo", "bar", "foo", "qux", "foo", "bar"} {
+		freq.Add(repo.Intern(str))
+	}
+	repo.Intern("unseen")
+
+	expected := []FrequencyEntry{
+		{"foo", 1, 3},
+		{"bar", 2, 2},
+		{"qux", 3, 1},
+		{"unseen", 4, 0},
+	}
+	report := repo.FrequencyReport(freq)
+	if len(report) != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected), len(report))
+	}
+	for i, entry := range report {
+		if entry != expected[i] {
+			t.Errorf("invalid entry %d: %+v", i, entry)
+		}
+	}
+}
+
+func TestOutOfMemory(t *testing.T) {
+	defer func() {
+		if r := recover(); r != ErrOutOfMemory {
+			t.Errorf("unexpected panic value: %v", r)
+		}
+	}()
+	outOfMemory()
+}
+
+func TestTryIntern(t *testing.T) {
+	repo := NewRepository()
+	if id, err := repo.TryIntern("foo"); err != nil || id != 1 {
+		t.Error("invalid TryIntern() result")
+	}
+	large := make([]byte, repo.PageSize())
+	for i := range large {
+		large[i] = 'x'
+	}
+	_, err := repo.TryIntern(string(large))
+	if !errors.Is(err, ErrStringTooLarge) {
+		t.Error("expected ErrStringTooLarge")
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.Length != len(large) {
+		t.Error("expected ErrStringTooLarge with the string length")
+	}
+}
+
+func TestInternSlice(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("qux")
+	ids, unique := repo.InternSlice([]string{"foo", "bar", "foo", "qux", "bar", "foo"})
+	expected := []uint32{2, 3, 2, 1, 3, 2}
+	if len(ids) != len(expected) {
+		t.Fatal("invalid InternSlice() result")
+	}
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Error("invalid InternSlice() result")
+		}
+	}
+	if len(unique) != 3 || unique[1] != "qux" || unique[2] != "foo" || unique[3] != "bar" {
+		t.Error("invalid InternSlice() result")
+	}
+
+	normalized := NewRepositoryWithOptions(Options{Normalize: strings.TrimSpace})
+	ids, unique = normalized.InternSlice([]string{" foo", "foo "})
+	if ids[0] != 1 || ids[1] != 1 || len(unique) != 1 || unique[1] != "foo" {
+		t.Errorf("expected the normalized string, got %v, %v", ids, unique)
+	}
+}
+
+func TestInternNonEmpty(t *testing.T) {
+	repo := NewRepository()
+	if id, err := repo.InternNonEmpty("foo"); err != nil || id != 1 {
+		t.Error("invalid InternNonEmpty() result")
+	}
+	if _, err := repo.InternNonEmpty(""); err != ErrEmptyString {
+		t.Error("expected ErrEmptyString")
+	}
+	if repo.Count() != 1 {
+		t.Error("unexpected string in repository")
+	}
+	if id := repo.Intern(""); id != 2 {
+		t.Error("invalid Intern() result")
+	}
+}
+
+func TestStaging(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+
+	staging := repo.Begin()
+	repo.Intern("bar")
+	staging.Commit()
+	if err := staging.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	assertStrings(t, repo, []string{"foo", "bar"})
+
+	staging = repo.Begin()
+	repo.Intern("qux")
+	if err := staging.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	assertStrings(t, repo, []string{"foo", "bar"})
+	staging.Commit()
+	if err := staging.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStagingNested(t *testing.T) {
+	repo := NewRepository()
+	outer := repo.Begin()
+	repo.Intern("foo")
+	inner := repo.Begin()
+	repo.Intern("bar")
+	if err := inner.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	repo.Intern("qux")
+	outer.Commit()
+	assertStrings(t, repo, []string{"foo", "qux"})
+
+	outer = repo.Begin()
+	repo.Intern("a")
+	inner = repo.Begin()
+	repo.Intern("b")
+	inner.Commit()
+	if err := outer.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	assertStrings(t, repo, []string{"foo", "qux"})
+
+	outer = repo.Begin()
+	repo.Intern("c")
+	inner = repo.Begin()
+	repo.Intern("d")
+	if err := outer.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	repo.Intern("e")
+	if err := inner.Rollback(); err != ErrInvalidSnapshot {
+		t.Errorf("expected ErrInvalidSnapshot after an outer rollback, got %v", err)
+	}
+}
+
+func TestCompactTo(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	repo.SetMeta(1, 42)
+	snapshot := repo.Snapshot()
+	for i := 0; i < 10000; i++ {
+		repo.Intern(fmt.Sprintf("string %d", i))
+	}
+	grown := repo.AllocatedBytes()
+
+	if err := repo.CompactTo(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	assertStrings(t, repo, []string{"foo"})
+	if repo.AllocatedBytes() >= grown {
+		t.Errorf("expected AllocatedBytes() to shrink from %d, got %d", grown, repo.AllocatedBytes())
+	}
+	if meta, ok := repo.GetMeta(1); !ok || meta != 42 {
+		t.Error("metadata was not kept")
+	}
+	if err := repo.CompactTo(snapshot); err != ErrInvalidSnapshot {
+		t.Error("expected snapshots to be invalidated")
+	}
+	if err := repo.CompactTo(NewRepository().Snapshot()); err != ErrInvalidSnapshot {
+		t.Error("expected ErrInvalidSnapshot")
+	}
+}
+
+func TestValidSnapshots(t *testing.T) {
+	repo := NewRepository()
+	start := repo.Snapshot()
+	repo.Intern("foo")
+	mid := repo.Snapshot()
+	repo.Intern("bar")
+	repo.Intern("qux")
+	end := repo.Snapshot()
+
+	if err := repo.Restore(mid); err != nil {
+		t.Fatal(err)
+	}
+	// regrow the repository past the end snapshot
+	for _, str := range []string{"a", "b", "c"} {
+		repo.Intern(str)
+	}
+	latest := repo.Snapshot()
+	other := NewRepository().Snapshot()
+
+	valid := repo.ValidSnapshots([]*Snapshot{start, mid, end, latest, other})
+	expected := []bool{true, true, false, true, false}
+	for i := range expected {
+		if valid[i] != expected[i] {
+			t.Errorf("invalid ValidSnapshots() result at %d", i)
+		}
+	}
+	if err := repo.Restore(start); err != nil {
+		t.Fatal(err)
+	}
+	valid = repo.ValidSnapshots([]*Snapshot{start, mid, latest})
+	if !valid[0] || valid[1] || valid[2] {
+		t.Error("invalid ValidSnapshots() result")
+	}
+}
+
+func TestAppend(t *testing.T) {
+	repo := NewRepository()
+	other := NewRepository()
+	for _, str := range []string{"foo", "bar"} {
+		repo.Intern(str)
+	}
+	for _, str := range []string{"foo", "bar", "qux", "xyz"} {
+		other.Intern(str)
+	}
+	if err := repo.Append(other); err != nil {
+		t.Fatal(err)
+	}
+	assertStrings(t, repo, []string{"foo", "bar", "qux", "xyz"})
+	assertStrings(t, other, []string{"foo", "bar", "qux", "xyz"})
+
+	// appending again is a no-op
+	if err := repo.Append(other); err != nil {
+		t.Fatal(err)
+	}
+	assertStrings(t, repo, []string{"foo", "bar", "qux", "xyz"})
+}
+
+func TestAppendDiverged(t *testing.T) {
+	repo := NewRepository()
+	other := NewRepository()
+	for _, str := range []string{"foo", "bar"} {
+		repo.Intern(str)
+	}
+	for _, str := range []string{"foo", "qux", "bar"} {
+		other.Intern(str)
+	}
+	if err := repo.Append(other); err != ErrDiverged {
+		t.Error("expected ErrDiverged")
+	}
+	assertStrings(t, repo, []string{"foo", "bar"})
+
+	other = NewRepository()
+	other.Intern("foo")
+	if err := repo.Append(other); err != ErrDiverged {
+		t.Error("expected ErrDiverged for a shorter repository")
+	}
+}
+
+func TestMeta(t *testing.T) {
+	repo := NewRepository()
+	foo := repo.Intern("foo")
+	bar := repo.Intern("bar")
+	repo.SetMeta(foo, 42)
+	repo.SetMeta(3, 1) // doesn't exist yet
+
+	for _, str := range []string{"qux", "xyz", "foo"} {
+		repo.Intern(str)
+	}
+	if meta, ok := repo.GetMeta(foo); !ok || meta != 42 {
+		t.Error("invalid GetMeta() result")
+	}
+	if _, ok := repo.GetMeta(bar); ok {
+		t.Error("invalid GetMeta() result")
+	}
+	if _, ok := repo.GetMeta(3); ok {
+		t.Error("invalid GetMeta() result")
+	}
+
+	snapshot := repo.Snapshot()
+	repo.SetMeta(bar, 7)
+	repo.SetMeta(repo.Intern("abc"), 9)
+	if meta, ok := repo.GetMeta(bar); !ok || meta != 7 {
+		t.Error("invalid GetMeta() result")
+	}
+	if err := repo.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	// metadata is discarded along with the strings it was attached to
+	if _, ok := repo.GetMeta(repo.Intern("def")); ok {
+		t.Error("invalid GetMeta() result after restore")
+	}
+}
+
+func TestGetOrIntern(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	misses := 0
+	onMiss := func() { misses++ }
+	if repo.GetOrIntern("bar", onMiss) != 2 || misses != 1 {
+		t.Error("invalid GetOrIntern() result for a new string")
+	}
+	if repo.GetOrIntern("bar", onMiss) != 2 || repo.GetOrIntern("foo", onMiss) != 1 || misses != 1 {
+		t.Error("invalid GetOrIntern() result for an existing string")
+	}
+}
+
+func TestIDs(t *testing.T) {
+	repo := NewRepository()
+	if len(repo.IDs()) != 0 {
+		t.Error("invalid IDs() result")
+	}
+	for _, str := range []string{"foo", "bar", "qux"} {
+		repo.Intern(str)
+	}
+	ids := repo.IDs()
+	if len(ids) != 3 || ids[0] != 1 || ids[1] != 2 || ids[2] != 3 {
+		t.Error("invalid IDs() result")
+	}
+}
+
+func TestIDCursor(t *testing.T) {
+	repo := NewRepository()
+	for i := 0; i < 1000; i++ {
+		repo.Intern(fmt.Sprintf("x%d", i))
+	}
+	cursor := repo.IDCursor()
+	i := uint32(0)
+	for cursor.Next() {
+		i++
+		if cursor.ID() != i {
+			t.Error("invalid cursor position")
+		}
+	}
+	if i != repo.Count() {
+		t.Error("invalid cursor operation(s)")
+	}
+
+	create := testing.AllocsPerRun(10, func() {
+		repo.IDCursor()
+	})
+	scan := testing.AllocsPerRun(10, func() {
+		cursor := repo.IDCursor()
+		for cursor.Next() {
+			cursor.ID()
+		}
+	})
+	if scan != create {
+		t.Errorf("scanning IDs allocated: %v allocs vs %v", scan, create)
+	}
+}
+
+func assertStringSlice(t *testing.T, actual, expected []string) {
+	if len(actual) != len(expected) {
+		t.Errorf("unexpected strings: %v", actual)
+		return
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("unexpected strings: %v", actual)
+			return
+		}
+	}
+}
+
+func TestFirstNLastN(t *testing.T) {
+	repo := NewRepository()
+	assertStringSlice(t, repo.FirstN(2), []string{})
+	assertStringSlice(t, repo.LastN(2), []string{})
+	for _, str := range []string{"foo", "bar", "qux", "xyz"} {
+		repo.Intern(str)
+	}
+	assertStringSlice(t, repo.FirstN(2), []string{"foo", "bar"})
+	assertStringSlice(t, repo.LastN(2), []string{"qux", "xyz"})
+	assertStringSlice(t, repo.FirstN(10), []string{"foo", "bar", "qux", "xyz"})
+	assertStringSlice(t, repo.LastN(10), []string{"foo", "bar", "qux", "xyz"})
+	assertStringSlice(t, repo.FirstN(0), []string{})
+	assertStringSlice(t, repo.LastN(-1), []string{})
+}
+
+func TestEqual(t *testing.T) {
+	repo := NewRepository()
+	other := NewRepository()
+	if !repo.Equal(other) {
+		t.Error("empty repositories should be equal")
+	}
+	repo.Intern("foo")
+	repo.Intern("bar")
+	other.Intern("foo")
+	if repo.Equal(other) || other.Equal(repo) {
+		t.Error("repositories with different counts should not be equal")
+	}
+	other.Intern("qux")
+	if repo.Equal(other) {
+		t.Error("repositories with different strings should not be equal")
+	}
+	other = NewRepository()
+	other.Intern("foo")
+	other.Intern("bar")
+	if !repo.Equal(other) {
+		t.Error("repositories should be equal")
+	}
+}
+
+func TestEqualDetailed(t *testing.T) {
+	repo := NewRepository()
+	other := NewRepository()
+	for _, str := range []string{"foo", "bar", "qux"} {
+		repo.Intern(str)
+	}
+	for _, str := range []string{"foo", "baz", "qux", "xyz"} {
+		other.Intern(str)
+	}
+	if equal, reason := repo.EqualDetailed(other); equal || reason != "count differs: 3 vs 4" {
+		t.Errorf("invalid EqualDetailed() result: %v, %q", equal, reason)
+	}
+	other.TrimToCount(3)
+	if equal, reason := repo.EqualDetailed(other); equal || reason != `id 2: got "bar", want "baz"` {
+		t.Errorf("invalid EqualDetailed() result: %v, %q", equal, reason)
+	}
+	if equal, reason := repo.EqualDetailed(repo.Clone()); !equal || reason != "" {
+		t.Errorf("invalid EqualDetailed() result: %v, %q", equal, reason)
+	}
+}
+
+func TestInternAllDedup(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	strs, ids := repo.InternAllDedup([]string{"bar", "foo", "qux", "bar", "xyz", "qux"})
+	assertStringSlice(t, strs, []string{"bar", "qux", "xyz"})
+	if len(ids) != 3 || ids[0] != 2 || ids[1] != 3 || ids[2] != 4 {
+		t.Error("invalid InternAllDedup() result")
+	}
+	strs, ids = repo.InternAllDedup([]string{"foo", "xyz"})
+	if len(strs) != 0 || len(ids) != 0 {
+		t.Error("invalid InternAllDedup() result")
+	}
+
+	normalized := NewRepositoryWithOptions(Options{Normalize: strings.TrimSpace})
+	normalized.Intern("foo")
+	strs, ids = normalized.InternAllDedup([]string{" foo", " bar", "bar "})
+	assertStringSlice(t, strs, []string{"bar"})
+	if len(ids) != 1 || ids[0] != 2 {
+		t.Errorf("invalid InternAllDedup() result with Normalize: %v", ids)
+	}
+}
+
+func TestTryInternAllIDSpaceExhausted(t *testing.T) {
+	defer func(id uint32) { maxID = id }(maxID)
+	maxID = 3
+
+	repo := NewRepository()
+	repo.Intern("foo")
+	ids, err := repo.TryInternAll([]string{"bar", "foo", "qux", "bar", "xyz", "abc"})
+	if !errors.Is(err, ErrIDSpaceExhausted) {
+		t.Fatalf("expected ErrIDSpaceExhausted, got %v", err)
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.Index != 4 {
+		t.Error("expected the index of the first string that didn't fit")
+	}
+	if len(ids) != 4 || ids[0] != 2 || ids[1] != 1 || ids[2] != 3 || ids[3] != 2 {
+		t.Error("invalid partial TryInternAll() result")
+	}
+	if repo.Count() != 3 {
+		t.Error("expected interned strings to be left intact")
+	}
+	assertStrings(t, repo, []string{"foo", "bar", "qux"})
+
+	if id, err := repo.TryIntern("qux"); err != nil || id != 3 {
+		t.Error("expected existing strings to still be found")
+	}
+	if _, err := repo.TryIntern("xyz"); err != ErrIDSpaceExhausted {
+		t.Error("expected ErrIDSpaceExhausted")
+	}
+	ids, err = repo.InternAllProgress(context.Background(), []string{"foo", "xyz"}, nil)
+	if !errors.As(err, &e) || e.Index != 1 || len(ids) != 1 {
+		t.Error("expected InternAllProgress() to stop at the limit")
+	}
+	func() {
+		defer func() {
+			if r, ok := recover().(error); !ok || !errors.Is(r, ErrIDSpaceExhausted) {
+				t.Error("expected InternAll() to panic with ErrIDSpaceExhausted")
+			}
+		}()
+		repo.InternAll([]string{"xyz"})
+	}()
+}
+
+func TestInternWithPageInfo(t *testing.T) {
+	repo := NewRepository()
+	// make sure the first page has been allocated
+	repo.Intern("x")
+	// two of these fit in a page alongside "x", with room for per-string
+	// overhead, but a third can't
+	length := int(repo.PageSize()/2) - 16
+	for i, expected := range []bool{false, false, true} {
+		id, newPage := repo.InternWithPageInfo(strings.Repeat(string(rune('a'+i)), length))
+		if id != uint32(i+2) {
+			t.Fatal("invalid InternWithPageInfo() ID")
+		}
+		if newPage != expected {
+			t.Errorf("string %d: expected newPage to be %v", i, expected)
+		}
+	}
+	if _, newPage := repo.InternWithPageInfo("y"); newPage {
+		t.Error("expected a small string to fit in the new page")
+	}
+	if _, newPage := repo.InternWithPageInfo(strings.Repeat("a", length)); newPage {
+		t.Error("expected no new page for an existing string")
+	}
+}
+
+type color int
+
+func (c color) String() string {
+	return [...]string{"red", "green", "blue"}[c]
+}
+
+func TestInternStringer(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("green")
+	if id := repo.InternStringer(color(1)); id != 1 {
+		t.Error("invalid InternStringer() result for existing string")
+	}
+	if id := repo.InternStringer(color(2)); id != 2 {
+		t.Error("invalid InternStringer() result for new string")
+	}
+	assertStrings(t, repo, []string{"green", "blue"})
+}
+
+func TestInternBytesAll(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	buf := []byte("barfooqux")
+	bs := [][]byte{buf[:3], buf[3:6], buf[6:], buf[:3], buf[:0]}
+	ids := repo.InternBytesAll(bs)
+	expected := []uint32{2, 1, 3, 2, 4}
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Error("invalid InternBytesAll() result")
+		}
+	}
+	copy(buf, "xxxxxxxxx")
+	assertStrings(t, repo, []string{"foo", "bar", "qux", ""})
+
+	normalized := NewRepositoryWithOptions(Options{Normalize: strings.ToLower})
+	if id := normalized.InternBytes([]byte("FOO")); id != 1 || !normalized.Contains("foo") {
+		t.Error("expected InternBytes() to normalize")
+	}
+}
+
+func TestInternRunes(t *testing.T) {
+	repo := NewRepository()
+	expected := NewRepository()
+	for _, rs := range [][]rune{
+		[]rune("foo"),
+		[]rune("héllo, 世界"),
+		[]rune("foo"),
+		{},
+		{'a', utf8.MaxRune + 1, 0xD800},
+		[]rune("héllo"),
+	} {
+		if id, expectedID := repo.InternRunes(rs), expected.Intern(string(rs)); id != expectedID {
+			t.Errorf("expected ID %d for %q, got %d", expectedID, string(rs), id)
+		}
+	}
+	if !repo.Equal(expected) {
+		t.Error("expected InternRunes() to intern the same strings as Intern()")
+	}
+}
+
+func TestInternAllBatchCache(t *testing.T) {
+	var strs []string
+	for i := 0; i < 1000; i++ {
+		strs = append(strs, fmt.Sprintf("hot %d", i%5), fmt.Sprintf("cold %d", i))
+	}
+	for _, size := range []int{1, 3, 100} {
+		repo := NewRepositoryWithOptions(Options{BatchCacheSize: size})
+		repo.Intern("hot 4")
+		ids := repo.InternAll(strs)
+		for i, str := range strs {
+			if id, _ := repo.Lookup(str); ids[i] != id {
+				t.Fatalf("cache size %d: wrong ID for %q", size, str)
+			}
+		}
+	}
+
+	repo := NewRepositoryWithOptions(Options{BatchCacheSize: 10})
+	before := repo.InternAll([]string{"foo", "bar"})
+	staging := repo.Begin()
+	repo.InternAll([]string{"qux"})
+	staging.Rollback()
+	after := repo.InternAll([]string{"qux", "foo", "xyz", "qux"})
+	if before[0] != 1 || after[0] != 3 || after[1] != 1 || after[2] != 4 || after[3] != 3 {
+		t.Error("expected the cache not to outlive a batch")
+	}
+}
+
+func TestInternAllStrict(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	ids, err := repo.InternAllStrict([]string{"bar", "qux"})
+	if err != nil || len(ids) != 2 || ids[0] != 2 || ids[1] != 3 {
+		t.Fatalf("invalid InternAllStrict() result: %v, %v", ids, err)
+	}
+
+	for _, strs := range [][]string{
+		{"a", "b", "a", "c"},
+		{"a", "b", "foo", "c"},
+	} {
+		ids, err := repo.InternAllStrict(strs)
+		if ids != nil || !errors.Is(err, ErrDuplicateString) {
+			t.Fatalf("expected ErrDuplicateString, got %v", err)
+		}
+		var e *Error
+		if !errors.As(err, &e) || e.Index != 2 || e.String != strs[2] {
+			t.Errorf("invalid error detail: %v", err)
+		}
+		assertStrings(t, repo, []string{"foo", "bar", "qux"})
+	}
+}
+
+func TestInternAllNew(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	ids, created := repo.InternAllNew([]string{"bar", "foo", "bar", "qux", "qux"})
+	expectedIDs := []uint32{2, 1, 2, 3, 3}
+	expectedCreated := []bool{true, false, false, true, false}
+	for i := range expectedIDs {
+		if ids[i] != expectedIDs[i] || created[i] != expectedCreated[i] {
+			t.Fatalf("invalid InternAllNew() result: %v, %v", ids, created)
+		}
+	}
+}
+
+func TestInternAllCollect(t *testing.T) {
+	repo := NewRepository()
+	large := strings.Repeat("x", int(repo.PageSize()))
+	ids, errs := repo.InternAllCollect([]string{"foo", large, "bar", "foo", large + "y"})
+	if len(ids) != 5 || len(errs) != 5 {
+		t.Fatalf("invalid InternAllCollect() result: %v, %v", ids, errs)
+	}
+	for i, expected := range []uint32{1, 0, 2, 1, 0} {
+		if ids[i] != expected {
+			t.Errorf("expected ID %d at %d, got %d", expected, i, ids[i])
+		}
+		if failed := expected == 0; failed != errors.Is(errs[i], ErrStringTooLarge) {
+			t.Errorf("unexpected error at %d: %v", i, errs[i])
+		}
+	}
+	assertStrings(t, repo, []string{"foo", "bar"})
+}
+
+func TestInternStream(t *testing.T) {
+	repo := NewRepository()
+	in := make(chan string)
+	go func() {
+		for i := 0; i < 10; i++ {
+			in <- fmt.Sprintf("string %d", i%7)
+		}
+		close(in)
+	}()
+	var batches [][]uint32
+	for batch := range repo.InternStream(context.Background(), in, 4) {
+		if batch.Err != nil {
+			t.Fatal(batch.Err)
+		}
+		batches = append(batches, batch.IDs)
+	}
+	if len(batches) != 3 || len(batches[0]) != 4 || len(batches[1]) != 4 || len(batches[2]) != 2 {
+		t.Fatalf("invalid batches: %v", batches)
+	}
+	expected := []uint32{1, 2, 3, 4, 5, 6, 7, 1, 2, 3}
+	for i, id := range append(append(batches[0], batches[1]...), batches[2]...) {
+		if id != expected[i] {
+			t.Errorf("invalid ID at %d", i)
+		}
+	}
+
+	empty := make(chan string)
+	close(empty)
+	if _, ok := <-repo.InternStream(context.Background(), empty, 4); ok {
+		t.Error("expected no batches from an empty stream")
+	}
+}
+
+func TestInternStreamError(t *testing.T) {
+	repo := NewRepository()
+	in := make(chan string, 10)
+	for _, str := range []string{"foo", "bar", strings.Repeat("x", int(pageSize)), "qux", "xyz"} {
+		in <- str
+	}
+	close(in)
+	out := repo.InternStream(context.Background(), in, 2)
+	first, second := <-out, <-out
+	if first.Err != nil || len(first.IDs) != 2 {
+		t.Errorf("invalid first batch: %+v", first)
+	}
+	if !errors.Is(second.Err, ErrStringTooLarge) || len(second.IDs) != 0 {
+		t.Errorf("expected ErrStringTooLarge, got %+v", second)
+	}
+	if _, ok := <-out; ok {
+		t.Error("expected the stream to stop after an error")
+	}
+	if repo.Contains("qux") {
+		t.Error("expected no strings to be interned after the error")
+	}
+}
+
+func TestInternStreamCancel(t *testing.T) {
+	repo := NewRepository()
+	in := make(chan string)
+	ctx, cancel := context.WithCancel(context.Background())
+	out := repo.InternStream(ctx, in, 1)
+	in <- "foo"
+	// stop reading without consuming the batch
+	cancel()
+	for range out {
+	}
+	select {
+	case in <- "bar":
+		t.Error("expected the stream to stop reading its input")
+	default:
+	}
+}
+
+func TestInternAllUnordered(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	strs := []string{"qux", "foo", "bar", "qux", "xyz", "bar"}
+	ids := repo.InternAllUnordered(strs)
+	if len(ids) != 4 || ids["foo"] != 1 || repo.Count() != 4 {
+		t.Error("invalid InternAllUnordered() result")
+	}
+	for _, str := range strs {
+		if id, ok := repo.Lookup(str); !ok || ids[str] != id {
+			t.Errorf("invalid ID for %q", str)
+		}
+	}
+}
+
+func assertOutOfMemory(t *testing.T, name string, fn func()) {
+	defer func() {
+		allocFailN = 0
+		if r := recover(); r != ErrOutOfMemory {
+			t.Errorf("%s: expected ErrOutOfMemory panic, got %v", name, r)
+		}
+	}()
+	allocFailN = 1
+	fn()
+}
+
+func TestOutOfMemoryPaths(t *testing.T) {
+	repo := NewRepository()
+	freq := NewFrequency()
+	assertOutOfMemory(t, "NewRepository", func() { NewRepository() })
+	assertOutOfMemory(t, "Intern", func() { repo.Intern("foo") })
+	assertOutOfMemory(t, "Optimize", func() { repo.Optimize(freq) })
+	assertOutOfMemory(t, "NewFrequency", func() { NewFrequency() })
+	assertOutOfMemory(t, "Frequency.Add", func() { freq.Add(1) })
+	assertOutOfMemory(t, "Frequency.AddAll", func() { freq.AddAll(repo) })
+
+	if repo.Count() != 0 {
+		t.Error("unexpected string in repository")
+	}
+	allocFailN = 2
+	if _, err := repo.TryIntern("foo"); err != nil {
+		t.Error("unexpected TryIntern() error")
+	}
+	if _, err := repo.TryIntern("bar"); err != ErrOutOfMemory {
+		t.Error("expected ErrOutOfMemory")
+	}
+	if _, err := repo.TryIntern("bar"); err != nil {
+		t.Error("unexpected TryIntern() error")
+	}
+}
+
+func TestContains(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	if !repo.Contains("foo") || repo.Contains("bar") {
+		t.Error("invalid Contains() result")
+	}
+}
+
+func TestSameStrings(t *testing.T) {
+	repo := NewRepository()
+	freq := NewFrequency()
+	for _, str := range []string{"foo", "bar", "qux", "qux", "bar", "qux"} {
+		freq.Add(repo.Intern(str))
+	}
+	optimized := repo.Optimize(freq)
+	if !repo.SameStrings(optimized) || !optimized.SameStrings(repo) {
+		t.Error("invalid SameStrings() result")
+	}
+	if repo.Equal(optimized) {
+		t.Error("invalid Equal() result")
+	}
+
+	other := NewRepository()
+	for _, str := range []string{"foo", "bar", "xyz"} {
+		other.Intern(str)
+	}
+	if repo.SameStrings(other) {
+		t.Error("invalid SameStrings() result")
+	}
+	other.Intern("qux")
+	if repo.SameStrings(other) {
+		t.Error("invalid SameStrings() result")
+	}
+}
+
+func TestLookupIDsInto(t *testing.T) {
+	repo := NewRepository()
+	for _, str := range []string{"foo", "bar", "qux"} {
+		repo.Intern(str)
+	}
+	dst, err := repo.LookupIDsInto([]uint32{3, 1, 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStringSlice(t, dst, []string{"qux", "foo", "foo"})
+
+	reused, err := repo.LookupIDsInto([]uint32{2, 3}, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStringSlice(t, reused, []string{"bar", "qux"})
+	if &reused[0] != &dst[0] {
+		t.Error("destination slice was not reused")
+	}
+
+	if _, err := repo.LookupIDsInto([]uint32{1, 4}, dst); err != ErrUnknownID {
+		t.Error("expected ErrUnknownID")
+	}
+}
+
+func TestEncodeColumn(t *testing.T) {
+	repo := NewRepository()
+	column := []string{"GET", "POST", "GET", "", "GET", "DELETE", "POST"}
+	ids := repo.EncodeColumn(column)
+	if len(ids) != len(column) || repo.Count() != 4 || ids[0] != ids[2] || ids[1] != ids[6] {
+		t.Error("invalid EncodeColumn() result")
+	}
+	values, err := repo.DecodeColumn(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStringSlice(t, values, column)
+
+	if values, err := repo.DecodeColumn([]uint32{1, 5}); err != ErrUnknownID || values != nil {
+		t.Error("expected ErrUnknownID")
+	}
+}
+
+func TestOptimizeThreshold(t *testing.T) {
+	repo := NewRepository()
+	for _, str := range []string{"a", "b", "c", "d", "e", "f"} {
+		repo.Intern(str)
+	}
+	freq := NewFrequency()
+	for id, count := range []int{0, 1, 5, 0, 3, 2, 5} {
+		for i := 0; i < count; i++ {
+			freq.Add(uint32(id))
+		}
+	}
+	optimized, remap := repo.OptimizeThreshold(freq, 3)
+	assertStrings(t, optimized, []string{"b", "f", "d", "a", "c", "e"})
+	expected := []uint32{0, 4, 1, 5, 3, 6, 2}
+	if len(remap) != len(expected) {
+		t.Fatal("invalid OptimizeThreshold() remap")
+	}
+	for i := range expected {
+		if remap[i] != expected[i] {
+			t.Error("invalid OptimizeThreshold() remap")
+		}
+	}
+
+	optimized, _ = repo.OptimizeThreshold(freq, 100)
+	if !optimized.Equal(repo) {
+		t.Error("expected original order when no string meets the threshold")
+	}
+}
+
+func TestOptimizeWith(t *testing.T) {
+	repo := NewRepository()
+	for _, str := range []string{"ccc", "a", "bb", "b", "aa", "z"} {
+		repo.Intern(str)
+	}
+	freq := NewFrequency()
+	for id, count := range []int{0, 2, 2, 2, 2, 5, 0} {
+		for i := 0; i < count; i++ {
+			freq.Add(uint32(id))
+		}
+	}
+	byLength := func(a, b FrequencyEntry) bool {
+		if len(a.String) != len(b.String) {
+			return len(a.String) < len(b.String)
+		}
+		return a.String < b.String
+	}
+	optimized, remap := repo.OptimizeWith(freq, byLength)
+	assertStrings(t, optimized, []string{"aa", "a", "b", "bb", "ccc", "z"})
+	expected := []uint32{0, 5, 2, 4, 3, 1, 6}
+	for i := range expected {
+		if remap[i] != expected[i] {
+			t.Error("invalid OptimizeWith() remap")
+		}
+	}
+
+	optimized, _ = repo.OptimizeWith(freq, func(a, b FrequencyEntry) bool { return false })
+	assertStrings(t, optimized, []string{"aa", "ccc", "a", "bb", "b", "z"})
+}
+
+func TestCompact(t *testing.T) {
+	repo := NewRepository()
+	for _, str := range []string{"foo", "bar", "baz", "qux"} {
+		repo.Intern(str)
+	}
+	freq := NewFrequency()
+	freq.Add(4)
+	freq.Add(2)
+	freq.Add(4)
+	compacted, remap := repo.Compact(freq)
+	assertStrings(t, compacted, []string{"bar", "qux"})
+	expected := []uint32{0, 0, 1, 0, 2}
+	if len(remap) != len(expected) {
+		t.Fatal("invalid Compact() remap")
+	}
+	for i := range expected {
+		if remap[i] != expected[i] {
+			t.Error("invalid Compact() remap")
+		}
+	}
+}
+
+func TestOnGrowthThreshold(t *testing.T) {
+	repo := NewRepository()
+	threshold := repo.AllocatedBytes() + 2*repo.PageSize()
+	calls := 0
+	repo.OnGrowthThreshold(threshold, func(current uint64) {
+		calls++
+		if current <= threshold {
+			t.Error("callback fired below the threshold")
+		}
+	})
+	for i := 0; repo.AllocatedBytes() <= threshold; i++ {
+		if calls != 0 {
+			t.Fatal("callback fired early")
+		}
+		repo.Intern(fmt.Sprintf("x%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		repo.Intern(fmt.Sprintf("y%d", i))
+	}
+	if calls != 1 {
+		t.Errorf("expected the callback to fire once, fired %d times", calls)
+	}
+}
+
+func TestInternAllProgress(t *testing.T) {
+	defer func(size int) { progressChunkSize = size }(progressChunkSize)
+	progressChunkSize = 3
+
+	strs := []string{"a", "b", "c", "d", "e", "f", "g", "a"}
+	repo := NewRepository()
+	var reports []int
+	ids, err := repo.InternAllProgress(context.Background(), strs, func(done int) {
+		reports = append(reports, done)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != len(strs) || ids[0] != 1 || ids[6] != 7 || ids[7] != 1 {
+		t.Error("invalid InternAllProgress() result")
+	}
+	if len(reports) != 3 || reports[0] != 3 || reports[1] != 6 || reports[2] != 8 {
+		t.Errorf("invalid progress reports: %v", reports)
+	}
+
+	repo = NewRepository()
+	ctx, cancel := context.WithCancel(context.Background())
+	ids, err = repo.InternAllProgress(ctx, strs, func(done int) {
+		if done >= 3 {
+			cancel()
+		}
+	})
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if len(ids) != 3 || repo.Count() != 3 {
+		t.Error("expected a partial result")
+	}
+
+	repo = NewRepository()
+	repo.Intern("a")
+	repo.SetByteLimit(repo.AllocatedBytes())
+	ids, err = repo.InternAllProgress(context.Background(), strs, nil)
+	if err != ErrCapacityExceeded {
+		t.Errorf("expected ErrCapacityExceeded, got %v", err)
+	}
+	if len(ids) != 1 || ids[0] != 1 {
+		t.Errorf("expected a partial result, got %v", ids)
+	}
+
+	repo = NewRepository()
+	allocFailN = 2
+	defer func() { allocFailN = 0 }()
+	ids, err = repo.InternAllProgress(context.Background(), strs, nil)
+	if err != ErrOutOfMemory || len(ids) != 1 {
+		t.Errorf("expected ErrOutOfMemory after one string, got %v, %v", ids, err)
+	}
+}
+
+type stopVisitor struct {
+	stopAt  uint32
+	visited []string
+}
+
+func (v *stopVisitor) Visit(id uint32, str string) Action {
+	v.visited = append(v.visited, str)
+	if id == v.stopAt {
+		return Stop
+	}
+	return Continue
+}
+
+func TestWalk(t *testing.T) {
+	repo := NewRepository()
+	for _, str := range []string{"foo", "bar", "qux"} {
+		repo.Intern(str)
+	}
+	all := &stopVisitor{}
+	repo.Walk(all)
+	assertStringSlice(t, all.visited, []string{"foo", "bar", "qux"})
+
+	partial := &stopVisitor{stopAt: 2}
+	repo.Walk(partial)
+	assertStringSlice(t, partial.visited, []string{"foo", "bar"})
+}
+
+func TestForEachBytes(t *testing.T) {
+	repo := NewRepository()
+	for _, str := range []string{"foo", "", "héllo", "bar"} {
+		repo.Intern(str)
+	}
+	var visited uint32
+	repo.ForEachBytes(func(id uint32, b []byte) bool {
+		visited++
+		if str, ok := repo.LookupID(id); !ok || string(b) != str || id != visited {
+			t.Errorf("invalid bytes for id %d", id)
+		}
+		return id < 3
+	})
+	if visited != 3 {
+		t.Errorf("expected ForEachBytes() to stop after 3 strings, visited %d", visited)
+	}
+
+	for i := 0; i < 1000; i++ {
+		repo.Intern(fmt.Sprintf("string %d", i))
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		repo.ForEachBytes(func(id uint32, b []byte) bool {
+			return true
+		})
+	})
+	if allocs > 2 {
+		t.Errorf("expected no allocations per string, got %v", allocs)
+	}
+}
+
+func TestHasAll(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	repo.Intern("")
+	repo.Intern("qux")
+	has := repo.HasAll([]string{"foo", "bar", "", "qux", "fo"})
+	expected := []bool{true, false, true, true, false}
+	if len(has) != len(expected) {
+		t.Fatal("invalid HasAll() result")
+	}
+	for i := range expected {
+		if has[i] != expected[i] {
+			t.Errorf("invalid HasAll() result at %d", i)
+		}
+	}
+}
+
+func TestCursorRemaining(t *testing.T) {
+	repo := NewRepository()
+	for _, str := range []string{"foo", "bar", "qux"} {
+		repo.Intern(str)
+	}
+	cursor := repo.Cursor()
+	if cursor.Remaining() != 3 {
+		t.Error("invalid Remaining() result before Next()")
+	}
+	for expected := uint32(2); cursor.Next(); expected-- {
+		if cursor.Remaining() != expected {
+			t.Errorf("invalid Remaining() result at id %d", cursor.ID())
+		}
+	}
+	if cursor.Remaining() != 0 {
+		t.Error("invalid Remaining() result after iteration")
+	}
+}
+
+func TestSnapshotCursor(t *testing.T) {
+	repo := NewRepository()
+	var strs []string
+	for i := 0; i < 1000; i++ {
+		strs = append(strs, fmt.Sprintf("string %d", i))
+		repo.Intern(strs[i])
+	}
+	cursor := repo.SnapshotCursor()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10000; i++ {
+			repo.Intern(fmt.Sprintf("new string %d", i))
+		}
+	}()
+
+	var visited []string
+	for cursor.Next() {
+		if cursor.ID() != uint32(len(visited)+1) {
+			t.Fatal("invalid ID() result")
+		}
+		if cursor.Remaining() != uint32(len(strs)-len(visited)-1) {
+			t.Fatal("invalid Remaining() result")
+		}
+		visited = append(visited, cursor.String())
+	}
+	<-done
+	assertStringSlice(t, visited, strs)
+	if cursor.ID() != 0 || cursor.String() != "" || cursor.Remaining() != 0 || cursor.Next() {
+		t.Error("expected the cursor to be exhausted")
+	}
+
+	cursor = repo.SnapshotCursor()
+	if !cursor.SkipN(1500) || cursor.String() != "new string 499" || cursor.SkipN(20000) {
+		t.Error("invalid SkipN() result")
+	}
+}
+
+func TestCursorAt(t *testing.T) {
+	repo := NewRepository()
+	strs := []string{"foo", "", "bar"}
+	for _, str := range strs {
+		repo.Intern(str)
+	}
+	for _, cursor := range []*Cursor{repo.Cursor(), repo.SnapshotCursor()} {
+		if id, str := cursor.At(); id != 0 || str != "" {
+			t.Error("invalid At() result before Next()")
+		}
+		for i := 0; cursor.Next(); i++ {
+			if id, str := cursor.At(); id != cursor.ID() || id != uint32(i+1) || str != strs[i] {
+				t.Errorf("invalid At() result at %d", i)
+			}
+		}
+		if id, str := cursor.At(); id != 0 || str != "" {
+			t.Error("invalid At() result after iteration")
+		}
+	}
+}
+
+func TestCursorSkipN(t *testing.T) {
+	repo := NewRepository()
+	strs := []string{"a", "b", "c", "d", "e", "f", "g"}
+	for _, str := range strs {
+		repo.Intern(str)
+	}
+	const pageSize = 3
+	page := func(n int) []string {
+		cursor := repo.Cursor()
+		if n > 0 && !cursor.SkipN(n*pageSize) {
+			return nil
+		}
+		var result []string
+		for len(result) < pageSize && cursor.Next() {
+			result = append(result, cursor.String())
+		}
+		return result
+	}
+	assertStringSlice(t, page(0), []string{"a", "b", "c"})
+	assertStringSlice(t, page(1), []string{"d", "e", "f"})
+	assertStringSlice(t, page(2), []string{"g"})
+	if result := page(3); len(result) != 0 {
+		t.Error("expected empty page")
+	}
+
+	cursor := repo.Cursor()
+	if !cursor.SkipN(2) || cursor.String() != "b" || !cursor.SkipN(0) || cursor.ID() != 2 {
+		t.Error("invalid SkipN() result")
+	}
+	if !cursor.Next() || cursor.String() != "c" {
+		t.Error("invalid Next() result after SkipN()")
+	}
+	if cursor.SkipN(5) || cursor.Next() || cursor.Remaining() != 0 {
+		t.Error("expected cursor to be exhausted")
+	}
+}
+
+func TestMergeMany(t *testing.T) {
+	shards := [][]string{
+		{"foo", "bar"},
+		{"bar", "qux"},
+		{"xyz", "foo", "qux"},
+	}
+	repos := make([]*Repository, len(shards))
+	for i, strs := range shards {
+		repos[i] = NewRepository()
+		for _, str := range strs {
+			repos[i].Intern(str)
+		}
+	}
+	merged, remaps := MergeMany(repos...)
+	assertStrings(t, merged, []string{"foo", "bar", "qux", "xyz"})
+	if len(remaps) != len(repos) {
+		t.Fatal("invalid MergeMany() remaps")
+	}
+	for i, repo := range repos {
+		if len(remaps[i]) != int(repo.Count()) {
+			t.Errorf("invalid remap size for repository %d", i)
+		}
+		for oldID, newID := range remaps[i] {
+			oldStr, _ := repo.LookupID(oldID)
+			if newStr, _ := merged.LookupID(newID); newStr != oldStr {
+				t.Errorf("invalid remap for repository %d: %d => %d", i, oldID, newID)
+			}
+		}
+	}
+	if remaps[2][1] != 4 || remaps[2][2] != 1 || remaps[2][3] != 3 {
+		t.Error("invalid MergeMany() remaps")
+	}
+
+	empty, remaps := MergeMany()
+	if empty.Count() != 0 || len(remaps) != 0 {
+		t.Error("invalid MergeMany() result")
+	}
+}
+
+func TestHashString(t *testing.T) {
+	if HashString("foo") != HashString(string([]byte("foo"))) {
+		t.Error("equal strings should hash equally")
+	}
+	if HashString("foo") == HashString("bar") {
+		t.Error("unexpected hash collision")
+	}
+	// the hash must be stable across runs and versions
+	if HashString("") != 0xcbf29ce484222325 || HashString("foo") != 0xdcb27518fed9d577 {
+		t.Error("invalid HashString() result")
+	}
+}
+
+func TestInternAll(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("qux")
+	ids := repo.InternAll([]string{"foo", "qux", "bar", "foo"})
+	if len(ids) != 4 || ids[0] != 2 || ids[1] != 1 || ids[2] != 3 || ids[3] != 2 {
+		t.Error("invalid InternAll() result")
+	}
+}
+
+func TestInternBatchParallel(t *testing.T) {
+	strs := make([]string, 10000)
+	for i := range strs {
+		strs[i] = fmt.Sprintf("x%d", i%3000)
+	}
+	for _, workers := range []int{0, 1, 3, 8} {
+		repo, ids, err := InternBatchParallel(strs, workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if repo.Count() != 3000 || len(ids) != len(strs) {
+			t.Fatalf("invalid InternBatchParallel() result with %d workers", workers)
+		}
+		for i, id := range ids {
+			if str, ok := repo.LookupID(id); !ok || str != strs[i] {
+				t.Fatalf("invalid ID for input %d with %d workers", i, workers)
+			}
+		}
+	}
+	repo, ids, err := InternBatchParallel(nil, 4)
+	if err != nil || repo.Count() != 0 || len(ids) != 0 {
+		t.Error("invalid InternBatchParallel() result")
+	}
+
+	strs[7000] = strings.Repeat("x", int(pageSize))
+	repo, ids, err = InternBatchParallel(strs, 4)
+	if !errors.Is(err, ErrStringTooLarge) || repo != nil || ids != nil {
+		t.Errorf("expected ErrStringTooLarge, got %v", err)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	repo := NewRepositoryWithOptions(Options{Normalize: strings.TrimSpace})
+	id := repo.Intern(" foo ")
+	if repo.Intern("foo") != id || repo.Intern("\tfoo") != id || repo.Count() != 1 {
+		t.Error("differently spaced strings should share an ID")
+	}
+	if str, _ := repo.LookupID(id); str != "foo" {
+		t.Error("expected the normalized string to be stored")
+	}
+	if lookupID, ok := repo.Lookup("foo  "); !ok || lookupID != id {
+		t.Error("invalid Lookup() result")
+	}
+	if !repo.Contains(" foo") || repo.Contains(" bar ") {
+		t.Error("invalid Contains() result")
+	}
+	if has := repo.HasAll([]string{"  foo", "bar"}); !has[0] || has[1] {
+		t.Error("invalid HasAll() result")
+	}
+	if _, err := repo.InternNonEmpty("   "); err != ErrEmptyString {
+		t.Error("expected ErrEmptyString for a string that normalizes to empty")
+	}
+}
+
+func TestRawPointer(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+
+	wrapper := NewRepositoryFromRawPointer(repo.RawPointer(), false)
+	if id, ok := wrapper.Lookup("foo"); !ok || id != 1 {
+		t.Error("invalid Lookup() result through wrapper")
+	}
+	if wrapper.Intern("bar") != 2 || repo.Count() != 2 {
+		t.Error("wrapper does not share the underlying repository")
+	}
+
+	// collecting the wrapper must not free the pointer
+	wrapper = nil
+	runtime.GC()
+	runtime.GC()
+	if str, ok := repo.LookupID(2); !ok || str != "bar" {
+		t.Error("underlying repository was freed by the wrapper")
+	}
+	runtime.KeepAlive(repo)
+}
+
+func TestDisableFinalizer(t *testing.T) {
+	pool := sync.Pool{New: func() interface{} {
+		repo := NewRepository()
+		repo.DisableFinalizer()
+		return repo
+	}}
+	repo := pool.Get().(*Repository)
+	repo.Intern("foo")
+	snapshot := repo.Snapshot()
+	repo.Intern("bar")
+	if err := repo.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(repo)
+	repo = nil
+	runtime.GC()
+
+	repo = pool.Get().(*Repository)
+	runtime.GC()
+	runtime.GC()
+	// the pool may have dropped the restored repository during GC
+	if repo.Count() > 1 {
+		t.Error("pooled repository was not restored")
+	}
+	repo.Intern("qux")
+	if !repo.Contains("qux") {
+		t.Error("pooled repository was freed")
+	}
+	repo.Close()
+	repo.Close()
+	if repo.RawPointer() != nil {
+		t.Error("expected Close() to release the pointer")
+	}
+}
+
+func TestCloseBorrowed(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	wrapper := NewRepositoryFromRawPointer(repo.RawPointer(), false)
+	wrapper.Close()
+	if str, ok := repo.LookupID(1); !ok || str != "foo" {
+		t.Error("Close() freed a pointer the repository doesn't own")
+	}
+}
+
+func TestRetainBorrowed(t *testing.T) {
+	repo := NewRepository()
+	for _, str := range []string{"foo", "bar", "qux"} {
+		repo.Intern(str)
+	}
+	wrapper := NewRepositoryFromRawPointer(repo.RawPointer(), false)
+	wrapper.Retain([]uint32{3})
+	if wrapper.RawPointer() == repo.RawPointer() {
+		t.Fatal("expected Retain() to detach the wrapper")
+	}
+	assertStrings(t, wrapper, []string{"qux"})
+	assertStrings(t, repo, []string{"foo", "bar", "qux"})
+
+	// the wrapper now owns its strings, so Close frees them, and collecting
+	// it must not affect the original pointer
+	wrapper.Close()
+	wrapper = nil
+	runtime.GC()
+	runtime.GC()
+	assertStrings(t, repo, []string{"foo", "bar", "qux"})
+}
+
+func TestRebuildBorrowed(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		rebuild  func(wrapper *Repository) error
+		expected []string
+	}{
+		{"OptimizeInPlace", func(wrapper *Repository) error {
+			freq := NewFrequency()
+			freq.Add(3)
+			wrapper.OptimizeInPlace(freq)
+			return nil
+		}, []string{"qux"}},
+		{"TrimToCount", func(wrapper *Repository) error {
+			return wrapper.TrimToCount(2)
+		}, []string{"foo", "bar"}},
+		{"CompactTo", func(wrapper *Repository) error {
+			snapshot := wrapper.Snapshot()
+			wrapper.Intern("xyz")
+			return wrapper.CompactTo(snapshot)
+		}, []string{"foo", "bar", "qux"}},
+	} {
+		repo := NewRepository()
+		for _, str := range []string{"foo", "bar", "qux"} {
+			repo.Intern(str)
+		}
+		wrapper := NewRepositoryFromRawPointer(repo.RawPointer(), false)
+		if err := test.rebuild(wrapper); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if wrapper.RawPointer() == repo.RawPointer() {
+			t.Errorf("%s: expected the wrapper to be detached", test.name)
+		}
+		assertStrings(t, wrapper, test.expected)
+		wrapper.Close()
+		if repo.Count() < 3 {
+			t.Errorf("%s: the original strings were modified", test.name)
+		}
+		if str, ok := repo.LookupID(1); !ok || str != "foo" {
+			t.Errorf("%s: the original strings were freed", test.name)
+		}
+	}
+}
+
+func TestCursorModification(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	repo.Intern("bar")
+
+	// interning existing strings is not a modification
+	cursor := repo.Cursor()
+	for cursor.Next() {
+		repo.Intern(cursor.String())
+	}
+
+	assertModificationPanic := func(name string, modify func()) {
+		defer func() {
+			if r := recover(); r != "intern: concurrent modification during iteration" {
+				t.Errorf("%s: unexpected panic value: %v", name, r)
+			}
+		}()
+		cursor := repo.Cursor()
+		cursor.Next()
+		modify()
+		cursor.Next()
+	}
+	assertModificationPanic("Intern", func() { repo.Intern("qux") })
+	snapshot := repo.Snapshot()
+	repo.Intern("xyz")
+	assertModificationPanic("Restore", func() { repo.Restore(snapshot) })
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("expected IDCursor to panic")
+			}
+		}()
+		cursor := repo.IDCursor()
+		repo.Intern("abc")
+		cursor.Next()
+	}()
+}
+
+func TestLenByID(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	repo.Intern("")
+	if length, ok := repo.LenByID(1); !ok || length != 3 {
+		t.Error("invalid LenByID() result")
+	}
+	if length, ok := repo.LenByID(2); !ok || length != 0 {
+		t.Error("invalid LenByID() result")
+	}
+	if _, ok := repo.LenByID(3); ok {
+		t.Error("invalid LenByID() result")
+	}
+}
+
+func TestLengthHistogram(t *testing.T) {
+	repo := NewRepository()
+	if len(repo.LengthHistogram()) != 0 {
+		t.Error("invalid LengthHistogram() result")
+	}
+	for _, str := range []string{"a", "b", "foo", "bar", "qux", "hello", ""} {
+		repo.Intern(str)
+	}
+	histogram := repo.LengthHistogram()
+	if len(histogram) != 4 || histogram[0] != 1 || histogram[1] != 2 || histogram[3] != 3 || histogram[5] != 1 {
+		t.Errorf("invalid LengthHistogram() result: %v", histogram)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	repo := NewRepository()
+	repo.SetDebug(true)
+	for _, str := range []string{"foo", "bar", "", "héllo", "foo"} {
+		repo.Intern(str)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("expected a panic for a string containing NUL")
+			}
+		}()
+		repo.Intern("foo\x00bar")
+	}()
+
+	repo.SetDebug(false)
+	if repo.Intern("foo\x00bar") != 1 {
+		t.Error("expected the string to be truncated without debug mode")
+	}
+}
+
+func TestInternInto(t *testing.T) {
+	repo := NewRepository()
+	var column []uint32
+	for _, str := range []string{"foo", "bar", "foo"} {
+		id := repo.InternInto(str, &column)
+		if column[len(column)-1] != id {
+			t.Error("invalid InternInto() result")
+		}
+	}
+	if len(column) != 3 || column[0] != 1 || column[1] != 2 || column[2] != 1 {
+		t.Error("invalid InternInto() result")
+	}
+}
+
+func TestSample(t *testing.T) {
+	repo := NewRepository()
+	for i := 0; i < 100; i++ {
+		repo.Intern(fmt.Sprintf("x%d", i))
+	}
+	sample := repo.Sample(10, 42)
+	if len(sample) != 10 {
+		t.Fatal("invalid Sample() size")
+	}
+	seen := make(map[uint32]bool)
+	for _, id := range sample {
+		if id == 0 || id > repo.Count() || seen[id] {
+			t.Errorf("invalid sampled ID %d", id)
+		}
+		seen[id] = true
+	}
+	again := repo.Sample(10, 42)
+	for i := range sample {
+		if again[i] != sample[i] {
+			t.Error("Sample() is not deterministic")
+		}
+	}
+
+	if all := repo.Sample(1000, 1); len(all) != 100 {
+		t.Error("invalid Sample() size when n exceeds the count")
+	}
+	if len(repo.Sample(0, 1)) != 0 || len(NewRepository().Sample(5, 1)) != 0 {
+		t.Error("expected an empty sample")
+	}
+}
+
+func TestIntersectIDs(t *testing.T) {
+	repo := NewRepository()
+	other := NewRepository()
+	for _, str := range []string{"foo", "bar", "qux", "xyz"} {
+		repo.Intern(str)
+	}
+	for _, str := range []string{"xyz", "abc", "bar"} {
+		other.Intern(str)
+	}
+	ids := repo.IntersectIDs(other)
+	if len(ids) != 2 || ids[0] != 2 || ids[1] != 4 {
+		t.Errorf("invalid IntersectIDs() result: %v", ids)
+	}
+	if len(repo.IntersectIDs(NewRepository())) != 0 {
+		t.Error("invalid IntersectIDs() result")
+	}
+}
+
+func TestTranslateIDs(t *testing.T) {
+	repo := NewRepository()
+	from := NewRepository()
+	for _, str := range []string{"foo", "bar", "qux"} {
+		repo.Intern(str)
+	}
+	for _, str := range []string{"qux", "abc", "foo"} {
+		from.Intern(str)
+	}
+	ids, found := repo.TranslateIDs(from, []uint32{1, 2, 3, 3, 0, 4})
+	expectedIDs := []uint32{3, 0, 1, 1, 0, 0}
+	expectedFound := []bool{true, false, true, true, false, false}
+	for i := range expectedIDs {
+		if ids[i] != expectedIDs[i] || found[i] != expectedFound[i] {
+			t.Fatalf("invalid TranslateIDs() result: %v, %v", ids, found)
+		}
+	}
+}
+
+func TestDifferenceStrings(t *testing.T) {
+	baseline := NewRepository()
+	current := NewRepository()
+	for _, str := range []string{"foo", "bar", "qux"} {
+		baseline.Intern(str)
+	}
+	for _, str := range []string{"abc", "bar", "foo", "xyz"} {
+		current.Intern(str)
+	}
+	assertStringSlice(t, current.DifferenceStrings(baseline), []string{"abc", "xyz"})
+	assertStringSlice(t, baseline.DifferenceStrings(current), []string{"qux"})
+	assertStringSlice(t, baseline.DifferenceStrings(baseline), []string{})
+}
+
+func TestSanitizeControl(t *testing.T) {
+	input := "foo\x00\tbar\x7f\u0085"
+
+	repo := NewRepository()
+	if _, err := repo.TryIntern("foo\tbar"); err != nil {
+		t.Error("control characters should be allowed by default")
+	}
+
+	repo = NewRepositoryWithOptions(Options{SanitizeControl: Strip})
+	id := repo.Intern(input)
+	if str, _ := repo.LookupID(id); str != "foobar" {
+		t.Errorf("expected control characters to be stripped, got %q", str)
+	}
+	if lookupID, ok := repo.Lookup("foo\nbar"); !ok || lookupID != id {
+		t.Error("invalid Lookup() result")
+	}
+	if repo.Intern("héllo\x1b") != repo.Intern("héllo") {
+		t.Error("expected multibyte characters to be preserved")
+	}
+
+	repo = NewRepositoryWithOptions(Options{SanitizeControl: Reject})
+	if _, err := repo.TryIntern(input); err != ErrControlCharacter {
+		t.Errorf("expected ErrControlCharacter, got %v", err)
+	}
+	if repo.Count() != 0 || repo.Contains(input) {
+		t.Error("unexpected string in repository")
+	}
+	if _, err := repo.TryIntern("foobar"); err != nil {
+		t.Error("unexpected TryIntern() error")
+	}
+
+	// sanitization is applied after normalization
+	repo = NewRepositoryWithOptions(Options{Normalize: strings.TrimSpace, SanitizeControl: Reject})
+	if _, err := repo.TryIntern("\tfoo\n"); err != nil {
+		t.Error("expected normalization to remove the control characters")
+	}
+}
+
+func TestSetByteLimit(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	repo.SetByteLimit(repo.AllocatedBytes())
+	if _, err := repo.TryIntern("bar"); err != ErrCapacityExceeded {
+		t.Errorf("expected ErrCapacityExceeded, got %v", err)
+	}
+	if id, err := repo.TryIntern("foo"); err != nil || id != 1 {
+		t.Errorf("expected existing string to be interned, got %d, %v", id, err)
+	}
+	if id, ok := repo.Lookup("foo"); !ok || id != 1 {
+		t.Error("expected lookups to work past the limit")
+	}
+
+	// until a new page is seen, each string needs room for one
+	limit := repo.AllocatedBytes() + pageSize + 1024
+	repo.SetByteLimit(limit)
+	var interned int
+	for ; interned < 1000; interned++ {
+		if _, err := repo.TryIntern(fmt.Sprintf("string %d", interned)); err == ErrCapacityExceeded {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if interned == 0 || interned == 1000 {
+		t.Errorf("expected the limit to stop interning, interned %d strings", interned)
+	}
+
+	repo.SetByteLimit(0)
+	if _, err := repo.TryIntern("bar"); err != nil {
+		t.Errorf("expected no error after removing the limit, got %v", err)
+	}
+}
+
+func TestSetByteLimitPages(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	limit := repo.AllocatedBytes() + 3*pageSize
+	repo.SetByteLimit(limit)
+	// each string takes a third of a page, so they regularly spill into a
+	// new page
+	length := int(pageSize/3) - 16
+	var interned int
+	for ; interned < 100; interned++ {
+		str := strings.Repeat(string(rune('a'+interned%26)), length) + fmt.Sprint(interned)
+		if _, err := repo.TryIntern(str); err == ErrCapacityExceeded {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if repo.AllocatedBytes() > limit {
+			t.Fatalf("AllocatedBytes() %d exceeds the limit %d after %d strings", repo.AllocatedBytes(), limit, interned+1)
+		}
+	}
+	// at least the first two pages can be filled
+	if interned < 4 || interned == 100 {
+		t.Errorf("expected the limit to stop interning after a few pages, interned %d strings", interned)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("foo")
+	snapshot := repo.Snapshot()
+	repo.Intern("bar")
+	repo.Freeze()
+
+	if _, err := repo.TryIntern("qux"); err != ErrFrozen {
+		t.Error("expected ErrFrozen")
+	}
+	if _, err := repo.TryIntern("foo"); err != ErrFrozen {
+		t.Error("expected ErrFrozen")
+	}
+	if err := repo.Restore(snapshot); err != ErrFrozen {
+		t.Error("expected ErrFrozen")
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != ErrFrozen {
+				t.Errorf("expected ErrFrozen panic, got %v", r)
+			}
+		}()
+		repo.Intern("qux")
+	}()
+
+	if id, ok := repo.Lookup("bar"); !ok || id != 2 {
+		t.Error("invalid Lookup() result")
+	}
+	if str, ok := repo.LookupID(1); !ok || str != "foo" {
+		t.Error("invalid LookupID() result")
+	}
+	if repo.Count() != 2 {
+		t.Error("invalid Count() result")
+	}
+}
+
+func TestClone(t *testing.T) {
+	repo := NewRepositoryWithOptions(Options{Normalize: strings.TrimSpace})
+	repo.Intern("foo")
+	repo.Intern("bar")
+	repo.SetMeta(1, 42)
+
+	for _, clone := range []*Repository{repo.Clone(), repo.CloneCOW()} {
+		if !clone.Equal(repo) {
+			t.Fatal("clone is not equal")
+		}
+		if meta, ok := clone.GetMeta(1); !ok || meta != 42 {
+			t.Error("metadata was not cloned")
+		}
+		if clone.Intern(" qux ") != 3 || clone.Count() != 3 {
+			t.Error("options were not cloned")
+		}
+		clone.SetMeta(2, 7)
+		assertStrings(t, repo, []string{"foo", "bar"})
+		if _, ok := repo.GetMeta(2); ok {
+			t.Error("clone shares metadata with the original")
+		}
+	}
+}
+
+func TestRetain(t *testing.T) {
+	repo := NewRepository()
+	for _, str := range []string{"foo", "bar", "baz", "qux"} {
+		repo.Intern(str)
+	}
+	repo.SetMeta(4, 42)
+	snapshot := repo.Snapshot()
+
+	remap := repo.Retain([]uint32{4, 2, 9})
+	assertStrings(t, repo, []string{"bar", "qux"})
+	expected := []uint32{0, 0, 1, 0, 2}
+	if len(remap) != len(expected) {
+		t.Fatal("invalid Retain() remap")
+	}
+	for i := range expected {
+		if remap[i] != expected[i] {
+			t.Error("invalid Retain() remap")
+		}
+	}
+	if repo.Contains("foo") || repo.Contains("baz") {
+		t.Error("dropped strings are still present")
+	}
+	if meta, ok := repo.GetMeta(2); !ok || meta != 42 {
+		t.Error("metadata was not remapped")
+	}
+	if err := repo.Restore(snapshot); err != ErrInvalidSnapshot {
+		t.Error("expected snapshots to be invalidated")
+	}
+	if repo.Intern("xyz") != 3 {
+		t.Error("invalid Intern() result after Retain()")
+	}
+}
+
+func TestOptimizeInPlace(t *testing.T) {
+	repo := NewRepository()
+	freq := NewFrequency()
+	for _, str := range []string{"foo", "bar", "qux", "bar", "qux", "qux"} {
+		freq.Add(repo.Intern(str))
+	}
+	repo.SetMeta(1, 42)
+	snapshot := repo.Snapshot()
+	optimized := repo.Optimize(freq)
+
+	remap := repo.OptimizeInPlace(freq)
+	if !repo.Equal(optimized) {
+		t.Error("expected the same result as Optimize()")
+	}
+	if len(remap) != 4 || remap[1] != 3 || remap[2] != 2 || remap[3] != 1 {
+		t.Error("invalid OptimizeInPlace() remap")
+	}
+	if meta, ok := repo.GetMeta(3); !ok || meta != 42 {
+		t.Error("metadata was not remapped")
+	}
+	if _, ok := repo.GetMeta(1); ok {
+		t.Error("metadata was not remapped")
+	}
+	if err := repo.Restore(snapshot); err != ErrInvalidSnapshot {
+		t.Error("expected snapshots to be invalidated")
+	}
+	if repo.Intern("xyz") != 4 {
+		t.Error("invalid Intern() result after OptimizeInPlace()")
+	}
+}
+
+func TestTrimToCount(t *testing.T) {
+	repo := NewRepository()
+	var strs []string
+	for i := 1; i <= 10; i++ {
+		strs = append(strs, fmt.Sprintf("string %d", i))
+		repo.Intern(strs[i-1])
+	}
+	repo.SetMeta(3, 42)
+
+	if err := repo.TrimToCount(11); err != ErrInvalidCount {
+		t.Errorf("expected ErrInvalidCount, got %v", err)
+	}
+	if err := repo.TrimToCount(4); err != nil {
+		t.Fatal(err)
+	}
+	assertStrings(t, repo, strs[:4])
+	for id := uint32(5); id <= 10; id++ {
+		if _, ok := repo.LookupID(id); ok {
+			t.Errorf("ID %d still exists", id)
+		}
+	}
+	if repo.Contains(strs[4]) || repo.Intern(strs[9]) != 5 {
+		t.Error("trimmed strings are still present")
+	}
+	if meta, ok := repo.GetMeta(3); !ok || meta != 42 {
+		t.Error("metadata was not kept")
+	}
+
+	if err := repo.TrimToCount(5); err != nil || repo.Count() != 5 {
+		t.Error("expected trimming to the current count to have no effect")
+	}
+	if err := repo.TrimToCount(0); err != nil || repo.Count() != 0 {
+		t.Error("expected trimming to zero to empty the repository")
+	}
+	repo.Freeze()
+	if err := repo.TrimToCount(0); err != ErrFrozen {
+		t.Error("expected ErrFrozen")
+	}
+}
+
+func TestNewFrequencyWithCapacity(t *testing.T) {
+	repo := NewRepository()
+	for _, str := range []string{"foo", "bar", "baz"} {
+		repo.Intern(str)
+	}
+	freq := NewFrequencyWithCapacity(repo.Count())
+	freq.AddAll(repo)
+	freq.Add(3)
+	if freq.count(3) != 2 || freq.count(1) != 1 || freq.count(4) != 0 {
+		t.Error("invalid frequency counts")
+	}
+	if optimized := repo.Optimize(freq); !optimized.SameStrings(repo) {
+		t.Error("invalid Optimize() result")
+	} else if str, _ := optimized.LookupID(1); str != "baz" {
+		t.Error("invalid Optimize() result")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	v1 := NewRepository()
+	v2 := NewRepository()
+	for _, str := range []string{"foo", "bar", "qux"} {
+		v1.Intern(str)
+	}
+	for _, str := range []string{"bar", "abc", "foo", "xyz"} {
+		v2.Intern(str)
+	}
+	added, removed := v2.Diff(v1)
+	assertStringSlice(t, added, []string{"abc", "xyz"})
+	assertStringSlice(t, removed, []string{"qux"})
+
+	added, removed = v1.Diff(v1.Clone())
+	if len(added) != 0 || len(removed) != 0 {
+		t.Error("expected no differences")
+	}
+}
@@ -0,0 +1,69 @@
+package intern
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lookupCache is a least recently used cache of the Go strings returned by
+// LookupID, used when Options.LookupCacheSize is set. It's safe for
+// concurrent use, since lookups on an unmodified repository are
+type lookupCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[uint32]*list.Element
+}
+
+type lookupCacheEntry struct {
+	id  uint32
+	str string
+}
+
+func newLookupCache(size int) *lookupCache {
+	return &lookupCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[uint32]*list.Element, size),
+	}
+}
+
+func (cache *lookupCache) get(id uint32) (string, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	elem, ok := cache.entries[id]
+	if !ok {
+		return "", false
+	}
+	cache.order.MoveToFront(elem)
+	return elem.Value.(*lookupCacheEntry).str, true
+}
+
+func (cache *lookupCache) add(id uint32, str string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if elem, ok := cache.entries[id]; ok {
+		// Another goroutine added the string after our miss
+		cache.order.MoveToFront(elem)
+		return
+	}
+	if cache.order.Len() >= cache.size {
+		oldest := cache.order.Back()
+		entry := oldest.Value.(*lookupCacheEntry)
+		delete(cache.entries, entry.id)
+		// Reuse the evicted element rather than allocating a new one
+		entry.id, entry.str = id, str
+		cache.order.MoveToFront(oldest)
+		cache.entries[id] = oldest
+		return
+	}
+	cache.entries[id] = cache.order.PushFront(&lookupCacheEntry{id, str})
+}
+
+// clear removes all strings from the cache
+func (cache *lookupCache) clear() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.order.Init()
+	cache.entries = make(map[uint32]*list.Element, cache.size)
+}
@@ -0,0 +1,50 @@
+package intern
+
+// Multiset interns strings while counting how many times each one was
+// added, so that both the number of distinct strings and the total number
+// of occurrences are tracked
+type Multiset struct {
+	repo     *Repository
+	freq     *Frequency
+	total    uint64
+	distinct uint32
+}
+
+// NewMultiset creates a new multiset that interns strings in repo
+func NewMultiset(repo *Repository) *Multiset {
+	return &Multiset{repo: repo, freq: NewFrequency()}
+}
+
+// Add interns a string, counts an occurrence of it and returns its ID
+func (set *Multiset) Add(str string) uint32 {
+	id := set.repo.Intern(str)
+	if set.freq.count(id) == 0 {
+		set.distinct++
+	}
+	set.freq.Add(id)
+	set.total++
+	return id
+}
+
+// Count returns the number of times the string with the specified ID was
+// added
+func (set *Multiset) Count(id uint32) uint64 {
+	return set.freq.count(id)
+}
+
+// Total returns the total number of strings added, including repeats
+func (set *Multiset) Total() uint64 {
+	return set.total
+}
+
+// Distinct returns the number of distinct strings added. It may be less
+// than the repository's Count if the repository is shared
+func (set *Multiset) Distinct() uint32 {
+	return set.distinct
+}
+
+// Frequency returns the occurrences counted so far, e.g. for use with
+// Optimize
+func (set *Multiset) Frequency() *Frequency {
+	return set.freq
+}
@@ -0,0 +1,31 @@
+package intern
+
+import "testing"
+
+func TestMultiset(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("unused")
+	set := NewMultiset(repo)
+	if set.Total() != 0 || set.Distinct() != 0 {
+		t.Error("expected an empty multiset")
+	}
+	for _, str := range []string{"foo", "bar", "foo", "qux", "foo", "bar"} {
+		set.Add(str)
+	}
+	if set.Total() != 6 {
+		t.Errorf("invalid Total() result: %d", set.Total())
+	}
+	if set.Distinct() != 3 || repo.Count() != 4 {
+		t.Errorf("invalid Distinct() result: %d", set.Distinct())
+	}
+	foo, _ := repo.Lookup("foo")
+	bar, _ := repo.Lookup("bar")
+	if set.Count(foo) != 3 || set.Count(bar) != 2 || set.Count(1) != 0 {
+		t.Error("invalid Count() result")
+	}
+
+	optimized := repo.Optimize(set.Frequency())
+	if id, _ := optimized.Lookup("foo"); id != 1 {
+		t.Error("expected the most frequent string to have ID 1")
+	}
+}
@@ -0,0 +1,26 @@
+package intern
+
+// Rows is the subset of *sql.Rows used by InternRows
+type Rows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+}
+
+// InternRows interns the string in the single column of each row and
+// returns the number of rows interned. *sql.Rows satisfies Rows. It stops
+// at the first scan error, and doesn't close rows
+func (repo *Repository) InternRows(rows Rows) (uint32, error) {
+	var count uint32
+	for rows.Next() {
+		var str string
+		if err := rows.Scan(&str); err != nil {
+			return count, err
+		}
+		if _, err := repo.TryIntern(str); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
@@ -0,0 +1,53 @@
+package intern
+
+import (
+	"fmt"
+	"testing"
+)
+
+type fakeRows struct {
+	values []interface{}
+	pos    int
+	err    error
+}
+
+func (rows *fakeRows) Next() bool {
+	if rows.pos >= len(rows.values) {
+		return false
+	}
+	rows.pos++
+	return true
+}
+
+func (rows *fakeRows) Scan(dest ...interface{}) error {
+	str, ok := rows.values[rows.pos-1].(string)
+	if !ok {
+		return fmt.Errorf("cannot scan %v into string", rows.values[rows.pos-1])
+	}
+	*dest[0].(*string) = str
+	return nil
+}
+
+func (rows *fakeRows) Err() error {
+	return rows.err
+}
+
+func TestInternRows(t *testing.T) {
+	repo := NewRepository()
+	count, err := repo.InternRows(&fakeRows{values: []interface{}{"foo", "bar", "foo"}})
+	if err != nil || count != 3 {
+		t.Errorf("invalid InternRows() result: %d, %v", count, err)
+	}
+	assertStrings(t, repo, []string{"foo", "bar"})
+
+	rows := &fakeRows{values: []interface{}{"qux", nil, "xyz"}}
+	if count, err := repo.InternRows(rows); err == nil || count != 1 {
+		t.Error("expected a scan error")
+	}
+	assertStrings(t, repo, []string{"foo", "bar", "qux"})
+
+	rowsErr := fmt.Errorf("connection reset")
+	if _, err := repo.InternRows(&fakeRows{err: rowsErr}); err != rowsErr {
+		t.Error("expected the rows error")
+	}
+}
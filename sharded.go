@@ -0,0 +1,127 @@
+package intern
+
+import "math"
+
+// ShardedRepository stores a collection of unique strings across multiple
+// repositories, so that it isn't limited to 2^32 strings. Strings are
+// interned into the last shard, and a new shard is added when it fills up.
+// IDs are 64-bit: the high 32 bits are the shard index and the low 32 bits
+// are the string's ID within the shard. Like Repository, it is *NOT* safe
+// to use from multiple goroutines without locking
+type ShardedRepository struct {
+	shards []*Repository
+	limit  uint32
+	opts   Options
+}
+
+// NewShardedRepository creates a new sharded string repository. Each
+// shard is created with the specified options and holds up to shardLimit
+// strings, or as many as its IDs allow if shardLimit is 0
+func NewShardedRepository(opts Options, shardLimit uint32) *ShardedRepository {
+	if shardLimit == 0 {
+		shardLimit = math.MaxUint32
+	}
+	sharded := &ShardedRepository{limit: shardLimit, opts: opts}
+	sharded.addShard()
+	return sharded
+}
+
+func (sharded *ShardedRepository) addShard() *Repository {
+	shard := NewRepositoryWithOptions(sharded.opts)
+	sharded.shards = append(sharded.shards, shard)
+	return shard
+}
+
+func shardedID(shard int, id uint32) uint64 {
+	return uint64(shard)<<32 | uint64(id)
+}
+
+func splitShardedID(id uint64) (shard int, local uint32) {
+	return int(id >> 32), uint32(id)
+}
+
+// Intern interns a string and returns its unique ID. It panics under the
+// same conditions as Repository.Intern, other than when IDs are exhausted
+func (sharded *ShardedRepository) Intern(str string) uint64 {
+	id, err := sharded.TryIntern(str)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// TryIntern interns a string and returns its unique ID. Strings are looked
+// up in the full shards before being interned into the last shard, so a
+// string keeps its ID after a new shard is added. It returns the same
+// errors as Repository.TryIntern, other than ErrIDSpaceExhausted
+func (sharded *ShardedRepository) TryIntern(str string) (uint64, error) {
+	last := len(sharded.shards) - 1
+	for i, shard := range sharded.shards[:last] {
+		if id, ok := shard.Lookup(str); ok {
+			return shardedID(i, id), nil
+		}
+	}
+	shard := sharded.shards[last]
+	if shard.Count() >= sharded.limit {
+		if id, ok := shard.Lookup(str); ok {
+			return shardedID(last, id), nil
+		}
+		shard = sharded.addShard()
+		last++
+	}
+	id, err := shard.TryIntern(str)
+	if err == ErrIDSpaceExhausted {
+		shard = sharded.addShard()
+		last++
+		id, err = shard.TryIntern(str)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return shardedID(last, id), nil
+}
+
+// InternAll interns each string in strs and returns their IDs. It panics
+// under the same conditions as Intern
+func (sharded *ShardedRepository) InternAll(strs []string) []uint64 {
+	ids := make([]uint64, len(strs))
+	for i, str := range strs {
+		ids[i] = sharded.Intern(str)
+	}
+	return ids
+}
+
+// Lookup returns the ID associated with a string, or false if the ID
+// does not exist in the repository
+func (sharded *ShardedRepository) Lookup(str string) (uint64, bool) {
+	for i, shard := range sharded.shards {
+		if id, ok := shard.Lookup(str); ok {
+			return shardedID(i, id), true
+		}
+	}
+	return 0, false
+}
+
+// LookupID returns the string associated with an ID, or false if the
+// string does not exist in the repository
+func (sharded *ShardedRepository) LookupID(id uint64) (string, bool) {
+	shard, local := splitShardedID(id)
+	if shard >= len(sharded.shards) {
+		return "", false
+	}
+	return sharded.shards[shard].LookupID(local)
+}
+
+// Count returns the total number of unique strings in the repository
+func (sharded *ShardedRepository) Count() uint64 {
+	var count uint64
+	for _, shard := range sharded.shards {
+		count += uint64(shard.Count())
+	}
+	return count
+}
+
+// Shards returns the number of shards in the repository
+func (sharded *ShardedRepository) Shards() int {
+	return len(sharded.shards)
+}
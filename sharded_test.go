@@ -0,0 +1,73 @@
+package intern
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestShardedRepository(t *testing.T) {
+	sharded := NewShardedRepository(Options{}, 3)
+	var strs []string
+	for i := 0; i < 8; i++ {
+		strs = append(strs, fmt.Sprintf("string %d", i))
+	}
+	ids := sharded.InternAll(strs)
+	if sharded.Shards() != 3 || sharded.Count() != 8 {
+		t.Fatalf("expected 8 strings in 3 shards, got %d in %d", sharded.Count(), sharded.Shards())
+	}
+	for i, id := range ids {
+		shard, local := splitShardedID(id)
+		if shard != i/3 || local != uint32(i%3)+1 {
+			t.Errorf("invalid ID for %q: shard %d, local %d", strs[i], shard, local)
+		}
+		if str, ok := sharded.LookupID(id); !ok || str != strs[i] {
+			t.Errorf("invalid LookupID() result for %d: %q", id, str)
+		}
+		if found, ok := sharded.Lookup(strs[i]); !ok || found != id {
+			t.Errorf("invalid Lookup() result for %q: %d", strs[i], found)
+		}
+	}
+
+	for i, str := range strs {
+		if id := sharded.Intern(str); id != ids[i] {
+			t.Errorf("expected %q to keep ID %d, got %d", str, ids[i], id)
+		}
+	}
+	if sharded.Shards() != 3 || sharded.Count() != 8 {
+		t.Error("expected repeats not to add strings")
+	}
+
+	for _, id := range []uint64{0, shardedID(0, 4), shardedID(3, 1)} {
+		if _, ok := sharded.LookupID(id); ok {
+			t.Errorf("expected ID %d to be absent", id)
+		}
+	}
+	if _, ok := sharded.Lookup("foo"); ok {
+		t.Error("expected foo to be absent")
+	}
+}
+
+func TestShardedRepositoryIDSpaceExhausted(t *testing.T) {
+	defer func(max uint32) { maxID = max }(maxID)
+	maxID = 2
+
+	sharded := NewShardedRepository(Options{}, 0)
+	ids := sharded.InternAll([]string{"foo", "bar", "qux", "foo"})
+	if sharded.Shards() != 2 || ids[2] != shardedID(1, 1) || ids[3] != ids[0] {
+		t.Errorf("invalid InternAll() result: %v", ids)
+	}
+	if str, ok := sharded.LookupID(ids[2]); !ok || str != "qux" {
+		t.Errorf("invalid LookupID() result: %q", str)
+	}
+}
+
+func TestShardedRepositoryError(t *testing.T) {
+	sharded := NewShardedRepository(Options{}, 1)
+	sharded.Intern("foo")
+	large := strings.Repeat("x", int(pageSize))
+	if _, err := sharded.TryIntern(large); !errors.Is(err, ErrStringTooLarge) {
+		t.Errorf("expected ErrStringTooLarge, got %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+package intern
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// sortedVersion is the current version of the format written by
+// WriteSortedTo
+const sortedVersion = 1
+
+// frontCodedVersion is the current version of the format written by
+// WriteFrontCoded
+const frontCodedVersion = 1
+
+type sortedEntry struct {
+	id  uint32
+	str string
+}
+
+type byString []sortedEntry
+
+func (s byString) Len() int           { return len(s) }
+func (s byString) Less(i, j int) bool { return s[i].str < s[j].str }
+func (s byString) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type byID []sortedEntry
+
+func (s byID) Len() int           { return len(s) }
+func (s byID) Less(i, j int) bool { return s[i].id < s[j].id }
+func (s byID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// sortedEntries returns the strings in the repository in lexicographic
+// order
+func (repo *Repository) sortedEntries() []sortedEntry {
+	entries := make([]sortedEntry, 0, repo.Count())
+	cursor := repo.Cursor()
+	for cursor.Next() {
+		entries = append(entries, sortedEntry{cursor.ID(), cursor.String()})
+	}
+	sort.Sort(byString(entries))
+	return entries
+}
+
+// WriteSortedTo writes the strings in the repository to w in lexicographic
+// order, prefixed with an index of entry offsets so that a consumer can
+// binary search the output for a string without loading it into memory.
+// All integers are little-endian. The layout is:
+//
+//	version   uint8
+//	count     uint32
+//	offsets   [count]uint64
+//	entries   [count]{id uint32, length uint32, bytes [length]byte}
+//
+// Offsets are relative to the start of the first entry. Each entry
+// includes the string's ID, since sorted order differs from ID order.
+// Consumers should reject versions newer than they understand
+func (repo *Repository) WriteSortedTo(w io.Writer) error {
+	entries := repo.sortedEntries()
+	bw := bufio.NewWriter(w)
+	var buf [8]byte
+	buf[0] = sortedVersion
+	binary.LittleEndian.PutUint32(buf[1:], uint32(len(entries)))
+	if _, err := bw.Write(buf[:5]); err != nil {
+		return err
+	}
+	var offset uint64
+	for _, entry := range entries {
+		binary.LittleEndian.PutUint64(buf[:], offset)
+		if _, err := bw.Write(buf[:]); err != nil {
+			return err
+		}
+		offset += 8 + uint64(len(entry.str))
+	}
+	for _, entry := range entries {
+		binary.LittleEndian.PutUint32(buf[:4], entry.id)
+		binary.LittleEndian.PutUint32(buf[4:], uint32(len(entry.str)))
+		if _, err := bw.Write(buf[:]); err != nil {
+			return err
+		}
+		if _, err := bw.WriteString(entry.str); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// InternAllSorted interns each string in strs and returns their IDs in
+// input order, along with the distinct input strings in lexicographic
+// order and their IDs
+func (repo *Repository) InternAllSorted(strs []string) (ids []uint32, sorted []string, sortedIDs []uint32) {
+	ids = repo.InternAll(strs)
+	seen := make(map[uint32]bool, len(ids))
+	var entries []sortedEntry
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			str, _ := repo.LookupID(id)
+			entries = append(entries, sortedEntry{id, str})
+		}
+	}
+	sort.Sort(byString(entries))
+	sorted = make([]string, len(entries))
+	sortedIDs = make([]uint32, len(entries))
+	for i, entry := range entries {
+		sorted[i] = entry.str
+		sortedIDs[i] = entry.id
+	}
+	return ids, sorted, sortedIDs
+}
+
+// InternAllSortedInput interns each string in strs and returns their IDs
+// in input order, like InternAll. The strings are interned in lexicographic
+// order rather than input order, so that new strings that are similar are
+// stored adjacently and assigned adjacent IDs, which improves locality when
+// they're looked up together
+func (repo *Repository) InternAllSortedInput(strs []string) []uint32 {
+	order := make([]int, len(strs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Sort(byIndexedString{strs, order})
+	ids := make([]uint32, len(strs))
+	for k, i := range order {
+		if k > 0 && strs[i] == strs[order[k-1]] {
+			ids[i] = ids[order[k-1]]
+			continue
+		}
+		ids[i] = repo.Intern(strs[i])
+	}
+	return ids
+}
+
+// byIndexedString sorts indexes into strs by the strings they refer to
+type byIndexedString struct {
+	strs  []string
+	order []int
+}
+
+func (s byIndexedString) Len() int           { return len(s.order) }
+func (s byIndexedString) Less(i, j int) bool { return s.strs[s.order[i]] < s.strs[s.order[j]] }
+func (s byIndexedString) Swap(i, j int)      { s.order[i], s.order[j] = s.order[j], s.order[i] }
+
+// WriteFrontCoded writes the repository to w using front coding, which is
+// much more compact than WriteTo when many strings share long prefixes
+// (e.g. URLs). Strings are sorted and each is stored as the length of the
+// prefix it shares with the previous string plus the remaining suffix. The
+// layout is:
+//
+//	version   uint8
+//	count     uint32 (little-endian)
+//	entries   [count]{id uvarint, shared uvarint, length uvarint, suffix [length]byte}
+//
+// The output can be read with ReadFrontCoded
+func (repo *Repository) WriteFrontCoded(w io.Writer) error {
+	entries := repo.sortedEntries()
+	bw := bufio.NewWriter(w)
+	var buf [3 * binary.MaxVarintLen32]byte
+	buf[0] = frontCodedVersion
+	binary.LittleEndian.PutUint32(buf[1:], uint32(len(entries)))
+	if _, err := bw.Write(buf[:5]); err != nil {
+		return err
+	}
+	var prev string
+	for _, entry := range entries {
+		shared := commonPrefix(prev, entry.str)
+		n := binary.PutUvarint(buf[:], uint64(entry.id))
+		n += binary.PutUvarint(buf[n:], uint64(shared))
+		n += binary.PutUvarint(buf[n:], uint64(len(entry.str)-shared))
+		if _, err := bw.Write(buf[:n]); err != nil {
+			return err
+		}
+		if _, err := bw.WriteString(entry.str[shared:]); err != nil {
+			return err
+		}
+		prev = entry.str
+	}
+	return bw.Flush()
+}
+
+func commonPrefix(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// ReadFrontCoded creates a new string repository from the output of
+// WriteFrontCoded, with the same strings and IDs. It returns an error
+// wrapping ErrUnsupportedVersion, with the version, if the input was
+// written by a newer version of this package, and ErrInvalidFormat or
+// io.ErrUnexpectedEOF if the input is malformed
+func ReadFrontCoded(r io.Reader) (*Repository, error) {
+	br := bufio.NewReader(r)
+	var header [5]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if header[0] == 0 {
+		return nil, ErrInvalidFormat
+	} else if header[0] > frontCodedVersion {
+		return nil, unsupportedVersion(int(header[0]))
+	}
+	count := binary.LittleEndian.Uint32(header[1:])
+
+	repo := NewRepository()
+	pageSize := repo.PageSize()
+	var entries []sortedEntry
+	var prev []byte
+	for i := uint32(0); i < count; i++ {
+		var fields [3]uint64
+		for j := range fields {
+			value, err := binary.ReadUvarint(br)
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			fields[j] = value
+		}
+		id, shared, length := fields[0], fields[1], fields[2]
+		if id == 0 || id > uint64(count) || shared > uint64(len(prev)) || shared+length >= pageSize {
+			return nil, ErrInvalidFormat
+		}
+		str := make([]byte, shared+length)
+		copy(str, prev[:shared])
+		if _, err := io.ReadFull(br, str[shared:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		entries = append(entries, sortedEntry{uint32(id), string(str)})
+		prev = str
+	}
+	sort.Sort(byID(entries))
+	for i, entry := range entries {
+		if entry.id != uint32(i+1) {
+			return nil, ErrInvalidFormat
+		}
+		if id, err := repo.TryIntern(entry.str); err != nil {
+			return nil, err
+		} else if id != entry.id {
+			return nil, ErrInvalidFormat
+		}
+	}
+	return repo, nil
+}
@@ -0,0 +1,204 @@
+package intern
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// sortedReader looks up strings in the output of WriteSortedTo by reading
+// only the index entries and strings visited by a binary search
+type sortedReader struct {
+	r     io.ReaderAt
+	count uint32
+}
+
+// sortedHeaderSize is the size of the version and count written by
+// WriteSortedTo
+const sortedHeaderSize = 5
+
+func newSortedReader(r io.ReaderAt) (*sortedReader, error) {
+	var buf [sortedHeaderSize]byte
+	if _, err := r.ReadAt(buf[:], 0); err != nil {
+		return nil, err
+	}
+	if buf[0] == 0 {
+		return nil, ErrInvalidFormat
+	} else if buf[0] > sortedVersion {
+		return nil, unsupportedVersion(int(buf[0]))
+	}
+	return &sortedReader{r, binary.LittleEndian.Uint32(buf[1:])}, nil
+}
+
+func (s *sortedReader) entry(i uint32) (uint32, string, error) {
+	var buf [8]byte
+	if _, err := s.r.ReadAt(buf[:], sortedHeaderSize+8*int64(i)); err != nil {
+		return 0, "", err
+	}
+	offset := sortedHeaderSize + 8*int64(s.count) + int64(binary.LittleEndian.Uint64(buf[:]))
+	if _, err := s.r.ReadAt(buf[:], offset); err != nil {
+		return 0, "", err
+	}
+	id := binary.LittleEndian.Uint32(buf[:4])
+	str := make([]byte, binary.LittleEndian.Uint32(buf[4:]))
+	if _, err := s.r.ReadAt(str, offset+8); err != nil && err != io.EOF {
+		return 0, "", err
+	}
+	return id, string(str), nil
+}
+
+func (s *sortedReader) lookup(str string) (uint32, bool, error) {
+	lo, hi := uint32(0), s.count
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		id, entry, err := s.entry(mid)
+		if err != nil {
+			return 0, false, err
+		}
+		switch {
+		case entry == str:
+			return id, true, nil
+		case entry < str:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return 0, false, nil
+}
+
+func TestWriteSortedTo(t *testing.T) {
+	repo := NewRepository()
+	strs := []string{"qux", "foo", "", "bar", "foobar", "baz"}
+	for _, str := range strs {
+		repo.Intern(str)
+	}
+
+	var buf bytes.Buffer
+	if err := repo.WriteSortedTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := newSortedReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.count != repo.Count() {
+		t.Error("invalid count")
+	}
+
+	var prev string
+	for i := uint32(0); i < reader.count; i++ {
+		_, str, err := reader.entry(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && str <= prev {
+			t.Error("entries are not sorted")
+		}
+		prev = str
+	}
+
+	for i, str := range strs {
+		id, ok, err := reader.lookup(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || int(id) != i+1 {
+			t.Errorf("invalid lookup result for %#v", str)
+		}
+	}
+	if _, ok, err := reader.lookup("xyz"); err != nil || ok {
+		t.Error("unexpected lookup result")
+	}
+
+	data := buf.Bytes()
+	if data[0] != sortedVersion {
+		t.Errorf("expected WriteSortedTo() to write version %d", sortedVersion)
+	}
+	data[0] = sortedVersion + 1
+	if _, err := newSortedReader(bytes.NewReader(data)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+func TestInternAllSorted(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("qux")
+	ids, sorted, sortedIDs := repo.InternAllSorted([]string{"foo", "bar", "foo", "baz", "qux"})
+	expectedIDs := []uint32{2, 3, 2, 4, 1}
+	if len(ids) != len(expectedIDs) {
+		t.Fatal("invalid InternAllSorted() IDs")
+	}
+	for i := range expectedIDs {
+		if ids[i] != expectedIDs[i] {
+			t.Error("invalid InternAllSorted() IDs")
+		}
+	}
+	assertStringSlice(t, sorted, []string{"bar", "baz", "foo", "qux"})
+	if len(sortedIDs) != len(sorted) {
+		t.Fatal("invalid InternAllSorted() sorted IDs")
+	}
+	for i, id := range sortedIDs {
+		if str, _ := repo.LookupID(id); str != sorted[i] {
+			t.Error("invalid InternAllSorted() sorted IDs")
+		}
+	}
+}
+
+func TestInternAllSortedInput(t *testing.T) {
+	repo := NewRepository()
+	repo.Intern("qux")
+	ids := repo.InternAllSortedInput([]string{"foo", "bar", "foo", "baz", "qux", "bar"})
+	expected := []uint32{4, 2, 4, 3, 1, 2}
+	if len(ids) != len(expected) {
+		t.Fatal("invalid InternAllSortedInput() IDs")
+	}
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Error("invalid InternAllSortedInput() IDs")
+		}
+	}
+	assertStrings(t, repo, []string{"qux", "bar", "baz", "foo"})
+}
+
+func TestFrontCoded(t *testing.T) {
+	repo := NewRepository()
+	for i := 0; i < 1000; i++ {
+		repo.Intern(fmt.Sprintf("https://example.com/some/long/path/%d", (i*7919)%1000))
+	}
+	repo.Intern("")
+	repo.Intern("héllo")
+
+	var frontCoded, plain bytes.Buffer
+	if err := repo.WriteFrontCoded(&frontCoded); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.WriteTo(&plain); err != nil {
+		t.Fatal(err)
+	}
+	if frontCoded.Len() >= plain.Len()/2 {
+		t.Errorf("front coding is not compact: %d vs %d bytes", frontCoded.Len(), plain.Len())
+	}
+	data := frontCoded.Bytes()
+
+	decoded, err := ReadFrontCoded(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(repo) {
+		t.Error("decoded repository is not equal")
+	}
+
+	if _, err := ReadFrontCoded(bytes.NewReader(data[:len(data)-1])); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	future := append([]byte{frontCodedVersion + 1}, data[1:]...)
+	_, err = ReadFrontCoded(bytes.NewReader(future))
+	var e *Error
+	if !errors.Is(err, ErrUnsupportedVersion) || !errors.As(err, &e) || e.Version != frontCodedVersion+1 {
+		t.Errorf("expected ErrUnsupportedVersion with the version, got %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package intern
+
+import "sync/atomic"
+
+// CallStats counts the cgo calls made by a repository and its cursors,
+// when Options.Instrument is set
+type CallStats struct {
+	// Intern is the number of calls that intern a string
+	Intern uint64
+	// Lookup is the number of calls that look up a string's ID
+	Lookup uint64
+	// LookupID is the number of calls that look up the string for an ID
+	LookupID uint64
+	// CursorNext is the number of calls that advance a cursor. SkipN
+	// advances a cursor with one call
+	CursorNext uint64
+}
+
+const (
+	callIntern = iota
+	callLookup
+	callLookupID
+	callCursorNext
+	numCalls
+)
+
+// callStats holds the counters behind CallStats. A nil *callStats counts
+// nothing, so instrumentation costs a nil check when it's disabled
+type callStats struct {
+	counts [numCalls]uint64
+}
+
+func (stats *callStats) add(call int) {
+	if stats != nil {
+		atomic.AddUint64(&stats.counts[call], 1)
+	}
+}
+
+// CallStats returns the number of cgo calls made by the repository and its
+// cursors since it was created. It returns zeros unless the repository was
+// created with Options.Instrument set
+func (repo *Repository) CallStats() CallStats {
+	stats := repo.stats
+	if stats == nil {
+		return CallStats{}
+	}
+	return CallStats{
+		Intern:     atomic.LoadUint64(&stats.counts[callIntern]),
+		Lookup:     atomic.LoadUint64(&stats.counts[callLookup]),
+		LookupID:   atomic.LoadUint64(&stats.counts[callLookupID]),
+		CursorNext: atomic.LoadUint64(&stats.counts[callCursorNext]),
+	}
+}
@@ -0,0 +1,30 @@
+package intern
+
+import "testing"
+
+func TestCallStats(t *testing.T) {
+	repo := NewRepositoryWithOptions(Options{Instrument: true})
+	for _, str := range []string{"foo", "bar", "foo"} {
+		repo.Intern(str)
+	}
+	repo.Lookup("foo")
+	repo.Lookup("qux")
+	repo.LookupID(1)
+	cursor := repo.Cursor()
+	for cursor.Next() {
+	}
+	repo.Cursor().SkipN(2)
+	repo.Cursor().SkipN(0)
+
+	expected := CallStats{Intern: 3, Lookup: 2, LookupID: 1, CursorNext: 4}
+	if stats := repo.CallStats(); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+
+	uninstrumented := NewRepository()
+	uninstrumented.Intern("foo")
+	uninstrumented.LookupID(1)
+	if stats := uninstrumented.CallStats(); stats != (CallStats{}) {
+		t.Errorf("expected no stats without Instrument, got %+v", stats)
+	}
+}